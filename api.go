@@ -2,6 +2,7 @@ package go_remote
 
 import (
 	"context"
+	"errors"
 	"reflect"
 )
 
@@ -12,35 +13,33 @@ type API struct {
 	WebSocket bool                   `json:"websocket,omitempty"`
 }
 
+// DataMessage is sent to websocket clients, when value of a variable was changed
+type DataMessage struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
 // JSON returns a json string representation of the end point
 func (s *Server) GetAPI(ctx context.Context) API {
 	out := API{}
 	out.Services = make(map[string]ServiceAPI)
 	out.Data = make(map[string]interface{})
+	ctx = withDependencyScope(ctx, CallScope)
+	defer closeDependencyScope(ctx, CallScope)
 
 	for key, value := range s.services {
 		out.Services[key] = value.GetAPI()
 	}
 
 	for key, value := range s.data {
+		if value.guard != nil && !value.guard(ctx) {
+			continue
+		}
+
 		if value.isConstant {
 			out.Data[key] = value.value
-		} else {
-			raw, ok, err := s.Dependencies.Value(value.rtype, ctx)
-			if !ok {
-				log.Errorf("can't resolve api variable: %s", key)
-				continue
-			}
-
-			if err != nil {
-				log.Errorf("error during resolving api variable: %s\n%f", key, err)
-				continue
-			}
-
-			if raw.Kind() == reflect.Ptr {
-				raw = raw.Elem()
-			}
-			out.Data[key] = raw.Interface()
+		} else if data, ok := s.variable(key, value, ctx, false); ok {
+			out.Data[key] = data
 		}
 	}
 
@@ -51,6 +50,90 @@ func (s *Server) GetAPI(ctx context.Context) API {
 	return out
 }
 
+// RefreshVariable recomputes the variable and sends its new value to all websocket clients
+func (s *Server) RefreshVariable(name string) error {
+	return s.refreshVariable(name, func(c *Client) bool { return true })
+}
+
+// RefreshUserVariable recomputes the variable for all websocket clients of the user
+func (s *Server) RefreshUserVariable(name string, user int) error {
+	return s.refreshVariable(name, func(c *Client) bool { return c.User == user })
+}
+
+// RefreshConnectionVariable recomputes the variable for a single websocket client
+func (s *Server) RefreshConnectionVariable(name string, conn ConnectionID) error {
+	return s.refreshVariable(name, func(c *Client) bool { return ConnectionID(c.ConnID) == conn })
+}
+
+func (s *Server) refreshVariable(name string, filter func(c *Client) bool) error {
+	record, ok := s.data[name]
+	if !ok || record.isConstant {
+		return errors.New("unknown variable name")
+	}
+
+	if !s.config.WebSocket {
+		return nil
+	}
+
+	// shared value is computed once, and clients receive the cached value
+	fresh := true
+	if s.Dependencies.shared(record.rtype) {
+		ctx := withDependencyScope(context.Background(), CallScope)
+		_, _, err := s.Dependencies.refresh(record.rtype, ctx)
+		closeDependencyScope(ctx, CallScope)
+		if err != nil {
+			return err
+		}
+		fresh = false
+	}
+
+	for _, c := range s.Events.findClients(filter) {
+		go s.pushVariable(c, name, record, fresh)
+	}
+
+	return nil
+}
+
+func (s *Server) pushVariable(c *Client, name string, record dataRecord, fresh bool) {
+	if record.guard != nil && !record.guard(c.ctx) {
+		return
+	}
+
+	ctx := withDependencyScope(c.ctx, CallScope)
+	defer closeDependencyScope(ctx, CallScope)
+
+	if value, ok := s.variable(name, record, ctx, fresh); ok {
+		c.SendMessage("data", &DataMessage{Name: name, Value: value})
+	}
+}
+
+// variable resolves value of the api variable through the dependency provider
+func (s *Server) variable(key string, value dataRecord, ctx context.Context, fresh bool) (interface{}, bool) {
+	var raw reflect.Value
+	var ok bool
+	var err error
+	if fresh {
+		raw, ok, err = s.Dependencies.refresh(value.rtype, ctx)
+	} else {
+		raw, ok, err = s.Dependencies.Value(value.rtype, ctx)
+	}
+
+	if !ok {
+		log.Errorf("can't resolve api variable: %s", key)
+		return nil, false
+	}
+
+	if err != nil {
+		log.Errorf("error during resolving api variable: %s\n%s", key, err)
+		return nil, false
+	}
+
+	if raw.Kind() == reflect.Ptr {
+		raw = raw.Elem()
+	}
+	return raw.Interface(), true
+}
+
 func (s *service) GetAPI() ServiceAPI {
 	out := ServiceAPI(make(map[string]int))
 
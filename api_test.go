@@ -0,0 +1,65 @@
+package go_remote
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshVariable(t *testing.T) {
+	tests := []struct {
+		scope    Scope
+		calls    int32
+		released int32
+	}{
+		{SingletonScope, 2, 1},
+		{ConnectionScope, 6, 3},
+	}
+
+	for _, test := range tests {
+		s := NewServer(&ServerConfig{WebSocket: true})
+		var calls, released int32
+		s.Dependencies.AddScopedProvider(func() (stubUser, func()) {
+			atomic.AddInt32(&calls, 1)
+			return stubUser{}, func() { atomic.AddInt32(&released, 1) }
+		}, test.scope)
+		s.AddVariable("user", stubUser{})
+
+		clients := make([]*Client, 3)
+		for i := range clients {
+			clients[i] = newTestClient(s, 1, i+1)
+			clients[i].ctx = withDependencyScope(context.Background(), ConnectionScope)
+			s.Events.connect(clients[i])
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := s.RefreshVariable("user"); err != nil {
+				t.Fatalf("scope %d: variable was not refreshed, %v", test.scope, err)
+			}
+			for _, c := range clients {
+				waitMessage(t, c, "data")
+			}
+		}
+
+		if atomic.LoadInt32(&calls) != test.calls || atomic.LoadInt32(&released) != test.released {
+			t.Errorf("scope %d: expected %d calls and %d released values, got %d and %d",
+				test.scope, test.calls, test.released, atomic.LoadInt32(&calls), atomic.LoadInt32(&released))
+		}
+		s.Events.Stop()
+	}
+}
+
+// waitMessage waits till the client has a queued message with the action
+func waitMessage(t *testing.T, c *Client, action string) {
+	for i := 0; i < 100; i++ {
+		for _, data := range c.queue.take() {
+			if strings.Contains(string(data), `"action":"`+action+`"`) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("connection %d didn't receive %s message", c.ConnID, action)
+}
@@ -3,71 +3,654 @@ package go_remote
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"reflect"
+	"runtime/debug"
+	"sync"
 )
 
 type dataRecord struct {
 	isConstant bool
 	rtype      reflect.Type
 	value      interface{}
+	guard      Guard
 }
 
 type DependencyProvider func(ctx context.Context) interface{}
 
+// Scope defines how long a value, returned by a dependency provider, is reused
+type Scope int
+
+const (
+	// CallScope computes the value once per method call
+	CallScope Scope = iota
+	// BatchScope computes the value once per batch of calls
+	BatchScope
+	// ConnectionScope computes the value once per http request or websocket connection
+	ConnectionScope
+	// SingletonScope computes the value once per server
+	SingletonScope
+)
+
+type scopeKey Scope
+
+// Inject can be embedded into a struct, which is used as a parameter of a method or provider,
+// fields of such struct are resolved as dependencies, and the "remote" tag of a field
+// selects a named dependency
+//
+//	type Databases struct {
+//		remote.Inject
+//		Primary *sql.DB `remote:"primary"`
+//		Replica *sql.DB `remote:"replica"`
+//	}
+type Inject struct{}
+
+type depKey struct {
+	rtype reflect.Type
+	name  string
+}
+
+type provider struct {
+	fn         reflect.Value
+	args       []reflect.Type
+	out        reflect.Type
+	scope      Scope
+	hasCleanup bool
+	hasError   bool
+}
+
 type dependencyStore struct {
-	data map[reflect.Type]reflect.Value
+	data      map[depKey]*provider
+	singleton *dependencyCache
+}
+
+// dependencyCache stores values computed in the scope
+type dependencyCache struct {
+	mu       sync.Mutex
+	values   map[*provider]*cachedValue
+	cleanups []func()
+}
+
+// cachedValue stores only successful results, so a failed provider is called again
+type cachedValue struct {
+	mu      sync.Mutex
+	ready   bool
+	value   reflect.Value
+	cleanup func()
 }
 
+var cleanupType = reflect.TypeOf((func())(nil))
+
 var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
 var contextInterface = reflect.TypeOf((*context.Context)(nil)).Elem()
+var closerInterface = reflect.TypeOf((*io.Closer)(nil)).Elem()
+var injectType = reflect.TypeOf(Inject{})
+var requestType = reflect.TypeOf((*http.Request)(nil))
+var clientType = reflect.TypeOf((*Client)(nil))
 
 func newDependencyStore() *dependencyStore {
-	return &dependencyStore{data: make(map[reflect.Type]reflect.Value)}
+	return &dependencyStore{
+		data:      make(map[depKey]*provider),
+		singleton: newDependencyCache(),
+	}
+}
+
+func newDependencyCache() *dependencyCache {
+	return &dependencyCache{values: make(map[*provider]*cachedValue)}
 }
 
+// withDependencyScope starts a new scope, values of providers with the same scope
+// will be computed only once for the returned context
+func withDependencyScope(ctx context.Context, scope Scope) context.Context {
+	return context.WithValue(ctx, scopeKey(scope), newDependencyCache())
+}
+
+// closeDependencyScope releases all values created in the scope of the context
+func closeDependencyScope(ctx context.Context, scope Scope) {
+	if cache, ok := ctx.Value(scopeKey(scope)).(*dependencyCache); ok {
+		cache.close()
+	}
+}
+
+// AddProvider registers a provider, which is called once per method call
 func (d *dependencyStore) AddProvider(provider interface{}) error {
-	pType := reflect.TypeOf(provider)
-	if pType.NumIn() != 1 || !pType.In(0).Implements(contextInterface) {
-		msg := "invalid data provider, provider must have a context as incoming parameter"
-		log.Errorf(msg)
-		return errors.New(msg)
+	return d.AddScopedProvider(provider, CallScope)
+}
+
+// AddScopedProvider registers a provider, which result is reused in the provided scope
+//
+// Provider can have any number of incoming parameters, context.Context, *http.Request
+// and *Client parameters receive the context of the call, the incoming request and the
+// websocket client ( nil for http calls ), all other parameters are resolved as dependencies.
+// Dependencies must have the same or a longer scope, so singletons can't use
+// the built-in parameters and values of the shorter scopes.
+// Provider returns a value, optional cleanup function and optional error,
+// cleanup function ( or Close method of the value ) is called when the scope ends
+func (d *dependencyStore) AddScopedProvider(fn interface{}, scope Scope) error {
+	return d.addProvider(fn, "", scope)
+}
+
+// AddNamedProvider registers a provider of a named dependency, such values
+// are available only through fields of a struct with the Inject marker
+func (d *dependencyStore) AddNamedProvider(name string, fn interface{}, scope Scope) error {
+	return d.addProvider(fn, name, scope)
+}
+
+func (d *dependencyStore) addProvider(fn interface{}, name string, scope Scope) error {
+	p, err := newProvider(fn, scope)
+	if err != nil {
+		log.Errorf(err.Error())
+		return err
+	}
+
+	key := depKey{rtype: keyOf(p.out), name: name}
+	old, hasOld := d.data[key]
+	d.data[key] = p
+
+	msg := ""
+	if d.dependsOn(p, p, make(map[*provider]bool)) {
+		msg = fmt.Sprintf("invalid data provider %s, circular dependency for %s", p.fn.Type(), p.out)
+	} else if err := d.checkScopes(); err != nil {
+		msg = err.Error()
 	}
-	if pType.NumOut() != 1 && (pType.NumOut() != 2 || pType.Out(1).Implements(errorInterface)) {
-		msg := "invalid data provider, provider must return a value and optional error"
+
+	if msg != "" {
+		if hasOld {
+			d.data[key] = old
+		} else {
+			delete(d.data, key)
+		}
+
 		log.Errorf(msg)
 		return errors.New(msg)
 	}
 
-	retType := pType.Out(0)
-	if retType.Kind() == reflect.Ptr {
-		retType = retType.Elem()
+	return nil
+}
+
+// checkScopes verifies that providers don't depend on values with a shorter scope,
+// such values are released while the dependent value is still in use
+func (d *dependencyStore) checkScopes() error {
+	for _, p := range d.data {
+		for _, arg := range p.args {
+			if scope, ok := builtinScope(arg); ok {
+				if scope < p.scope {
+					return fmt.Errorf("invalid data provider %s, %s parameter can't be used in a longer scope", p.fn.Type(), arg)
+				}
+				continue
+			}
+
+			for _, key := range requirements(arg) {
+				next, _ := d.lookup(key)
+				if next != nil && next.scope < p.scope {
+					return fmt.Errorf("invalid data provider %s, dependency %s has a shorter scope", p.fn.Type(), key.rtype)
+				}
+			}
+		}
 	}
-	d.data[retType] = reflect.ValueOf(provider)
+
 	return nil
 }
 
+// builtinScope returns the longest scope, where the built-in parameter stays valid
+func builtinScope(rtype reflect.Type) (Scope, bool) {
+	switch rtype {
+	case contextInterface, requestType, clientType:
+		return ConnectionScope, true
+	case streamType:
+		return CallScope, true
+	}
+
+	return 0, false
+}
+
+// newProvider validates signature of the provider function
+func newProvider(fn interface{}, scope Scope) (*provider, error) {
+	pType := reflect.TypeOf(fn)
+	if pType == nil || pType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("invalid data provider %v, provider must be a function", pType)
+	}
+	if pType.IsVariadic() {
+		return nil, fmt.Errorf("invalid data provider %s, variadic providers are not supported", pType)
+	}
+	if scope < CallScope || scope > SingletonScope {
+		return nil, fmt.Errorf("invalid data provider %s, unknown scope %d", pType, scope)
+	}
+
+	p := &provider{fn: reflect.ValueOf(fn), scope: scope}
+	valid := false
+	switch pType.NumOut() {
+	case 1:
+		valid = true
+	case 2:
+		p.hasCleanup = pType.Out(1) == cleanupType
+		p.hasError = pType.Out(1) == errorInterface
+		valid = p.hasCleanup || p.hasError
+	case 3:
+		p.hasCleanup = pType.Out(1) == cleanupType
+		p.hasError = pType.Out(2) == errorInterface
+		valid = p.hasCleanup && p.hasError
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid data provider %s, provider must return a value, optional cleanup function and optional error", pType)
+	}
+
+	p.out = pType.Out(0)
+	if p.out == errorInterface || p.out == cleanupType {
+		return nil, fmt.Errorf("invalid data provider %s, first result must be a value", pType)
+	}
+
+	p.args = make([]reflect.Type, pType.NumIn())
+	for i := range p.args {
+		p.args[i] = pType.In(i)
+		if p.args[i] == errorInterface {
+			return nil, fmt.Errorf("invalid data provider %s, error can't be used as a parameter", pType)
+		}
+	}
+
+	return p, nil
+}
+
+// refresh computes a new value of the dependency and replaces the value cached in its scope,
+// the previous value is released
+func (d *dependencyStore) refresh(rtype reflect.Type, ctx context.Context) (reflect.Value, bool, error) {
+	p, err := d.lookup(depKey{rtype: rtype})
+	if p == nil || err != nil {
+		return reflect.Value{}, err != nil, err
+	}
+
+	out, cleanup, err := d.call(p, ctx)
+	if err != nil {
+		log.Errorf("error during calculation %s\n%s", rtype.Name(), err.Error())
+		return reflect.Value{}, true, err
+	}
+	if cache := d.cache(p.scope, ctx); cache != nil {
+		cache.set(p, out, cleanup)
+	}
+
+	return adaptValue(out, rtype), true, nil
+}
+
+// shared checks whether the value of the dependency is shared by all connections
+func (d *dependencyStore) shared(rtype reflect.Type) bool {
+	p, _ := d.lookup(depKey{rtype: rtype})
+	return p != nil && p.scope == SingletonScope
+}
+
 func (d *dependencyStore) Value(rtype reflect.Type, ctx context.Context) (reflect.Value, bool, error) {
-	keyType := rtype
-	if rtype.Kind() == reflect.Ptr {
-		keyType = rtype.Elem()
+	out, ok, err := d.argument(rtype, ctx)
+	if err != nil {
+		log.Errorf("error during calculation %s\n%s", rtype.Name(), err.Error())
 	}
 
-	test, ok := d.data[keyType]
-	if !ok {
-		return reflect.Value{}, false, nil
+	return out, ok, err
+}
+
+// argument returns value for the parameter of a method or provider
+func (d *dependencyStore) argument(rtype reflect.Type, ctx context.Context) (reflect.Value, bool, error) {
+	switch rtype {
+	case contextInterface:
+		return reflect.ValueOf(&ctx).Elem(), true, nil
+	case requestType:
+		r, _ := ctx.Value(RequestValue).(*http.Request)
+		return reflect.ValueOf(r), true, nil
+	case clientType:
+		c, _ := ctx.Value(ClientValue).(*Client)
+		return reflect.ValueOf(c), true, nil
+	case streamType:
+		s, _ := ctx.Value(streamValue).(*Stream)
+		return reflect.ValueOf(s), true, nil
+	}
+
+	if isInjectStruct(rtype) {
+		out, err := d.inject(rtype, ctx)
+		return out, true, err
 	}
 
-	var args []reflect.Value
-	args = []reflect.Value{reflect.ValueOf(ctx)}
+	p, err := d.lookup(depKey{rtype: rtype})
+	if p == nil || err != nil {
+		return reflect.Value{}, err != nil, err
+	}
 
-	out := test.Call(args)
-	if len(out) > 1 {
-		err, _ := out[1].Interface().(error)
+	out, err := d.resolve(p, ctx)
+	if err != nil {
+		return reflect.Value{}, true, err
+	}
+
+	return adaptValue(out, rtype), true, nil
+}
+
+// inject creates a struct with the Inject marker and fills its fields
+func (d *dependencyStore) inject(rtype reflect.Type, ctx context.Context) (reflect.Value, error) {
+	st := keyOf(rtype)
+	out := reflect.New(st).Elem()
+
+	for _, key := range injectFields(st) {
+		p, err := d.lookup(key.depKey)
 		if err != nil {
-			log.Errorf("error during calculation %s\n%s", rtype.Name(), err.Error())
+			return reflect.Value{}, err
 		}
-		return out[0], true, err
+		if p == nil {
+			return reflect.Value{}, fmt.Errorf("missing dependency %s %q", key.rtype, key.name)
+		}
+
+		val, err := d.resolve(p, ctx)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.Field(key.index).Set(adaptValue(val, key.rtype))
+	}
+
+	return adaptValue(out, rtype), nil
+}
+
+// lookup finds provider for the type, interfaces can be resolved
+// by a provider which returns an implementation of the interface
+func (d *dependencyStore) lookup(key depKey) (*provider, error) {
+	if p, ok := d.data[depKey{rtype: keyOf(key.rtype), name: key.name}]; ok {
+		return p, nil
+	}
+
+	// empty interface is a valid type of json argument, so it is never matched
+	if key.rtype.Kind() != reflect.Interface || key.rtype.NumMethod() == 0 {
+		return nil, nil
+	}
+
+	var found *provider
+	for k, p := range d.data {
+		if k.name == key.name && p.out.Implements(key.rtype) {
+			if found != nil {
+				return nil, fmt.Errorf("ambiguous dependency %s, several providers implement it", key.rtype)
+			}
+			found = p
+		}
+	}
+
+	return found, nil
+}
+
+// dependsOn checks whether the provider requires the target provider,
+// directly or through other providers
+func (d *dependencyStore) dependsOn(p, target *provider, visited map[*provider]bool) bool {
+	visited[p] = true
+
+	for _, arg := range p.args {
+		for _, key := range requirements(arg) {
+			next, _ := d.lookup(key)
+			if next == nil {
+				continue
+			}
+
+			if next == target || (!visited[next] && d.dependsOn(next, target, visited)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (d *dependencyStore) resolve(p *provider, ctx context.Context) (reflect.Value, error) {
+	cache := d.cache(p.scope, ctx)
+	if cache == nil {
+		val, _, err := d.call(p, ctx)
+		return val, err
+	}
+
+	return cache.get(p, func() (reflect.Value, func(), error) {
+		return d.call(p, ctx)
+	})
+}
+
+// cache returns storage of the scope, when scope is not active
+// the closest shorter scope is used instead
+//
+// if there is no active scope at all, values are not cached and never released
+func (d *dependencyStore) cache(scope Scope, ctx context.Context) *dependencyCache {
+	if scope == SingletonScope {
+		return d.singleton
+	}
+
+	for s := scope; s >= CallScope; s-- {
+		if cache, ok := ctx.Value(scopeKey(s)).(*dependencyCache); ok {
+			return cache
+		}
+	}
+
+	return nil
+}
+
+func (d *dependencyStore) call(p *provider, ctx context.Context) (reflect.Value, func(), error) {
+	args := make([]reflect.Value, len(p.args))
+	for i, arg := range p.args {
+		val, ok, err := d.argument(arg, ctx)
+		if err != nil {
+			return reflect.Value{}, nil, err
+		}
+		if !ok {
+			return reflect.Value{}, nil, fmt.Errorf("missing dependency %s", arg)
+		}
+		args[i] = val
+	}
+
+	out, err := callProvider(p, args)
+	if err != nil {
+		return reflect.Value{}, nil, err
+	}
+	if p.hasError {
+		err, _ := out[len(out)-1].Interface().(error)
+		if err != nil {
+			return reflect.Value{}, nil, err
+		}
+	}
+
+	var cleanup func()
+	if p.hasCleanup {
+		cleanup, _ = out[1].Interface().(func())
+	} else if out[0].Type().Implements(closerInterface) {
+		cleanup = closeValue(out[0])
+	}
+
+	return out[0], cleanup, nil
+}
+
+// callProvider converts panic of the provider to an error
+func callProvider(p *provider, args []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf(string(debug.Stack()))
+			err = fmt.Errorf("panic in data provider %s: %v", p.fn.Type(), r)
+		}
+	}()
+
+	return p.fn.Call(args), nil
+}
+
+func (c *dependencyCache) get(p *provider, compute func() (reflect.Value, func(), error)) (reflect.Value, error) {
+	v := c.entry(p)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.ready {
+		return v.value, nil
+	}
+
+	value, cleanup, err := compute()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	v.value = value
+	v.ready = true
+	v.cleanup = cleanup
+	c.add(v.release)
+	return v.value, nil
+}
+
+func (c *dependencyCache) entry(p *provider) *cachedValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[p]
+	if !ok {
+		v = &cachedValue{}
+		c.values[p] = v
+	}
+	return v
+}
+
+// set replaces the cached value of the provider, the previous value is released
+func (c *dependencyCache) set(p *provider, value reflect.Value, cleanup func()) {
+	v := c.entry(p)
+
+	v.mu.Lock()
+	if !v.ready {
+		c.add(v.release)
+	}
+	previous := v.cleanup
+	v.value = value
+	v.ready = true
+	v.cleanup = cleanup
+	v.mu.Unlock()
+
+	if previous != nil {
+		runCleanup(previous)
+	}
+}
+
+// release calls cleanup of the current value
+func (v *cachedValue) release() {
+	v.mu.Lock()
+	cleanup := v.cleanup
+	v.cleanup = nil
+	v.mu.Unlock()
+
+	if cleanup != nil {
+		runCleanup(cleanup)
+	}
+}
+
+func (c *dependencyCache) add(cleanup func()) {
+	c.mu.Lock()
+	c.cleanups = append(c.cleanups, cleanup)
+	c.mu.Unlock()
+}
+
+// close calls cleanup functions in the reverse order, so values are released
+// before their own dependencies
+func (c *dependencyCache) close() {
+	c.mu.Lock()
+	cleanups := c.cleanups
+	c.cleanups = nil
+	c.mu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		runCleanup(cleanups[i])
+	}
+}
+
+func runCleanup(cleanup func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("error during dependency cleanup\n%v", r)
+		}
+	}()
+
+	cleanup()
+}
+
+func closeValue(val reflect.Value) func() {
+	return func() {
+		if val.Kind() == reflect.Ptr && val.IsNil() {
+			return
+		}
+
+		if err := val.Interface().(io.Closer).Close(); err != nil {
+			log.Errorf("error during dependency cleanup\n%s", err.Error())
+		}
+	}
+}
+
+type injectField struct {
+	depKey
+	index int
+}
+
+func isInjectStruct(rtype reflect.Type) bool {
+	st := keyOf(rtype)
+	if st.Kind() != reflect.Struct {
+		return false
+	}
+
+	for i := 0; i < st.NumField(); i++ {
+		if f := st.Field(i); f.Anonymous && f.Type == injectType {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFields returns dependencies of all exported fields of the struct with the Inject marker
+func injectFields(st reflect.Type) []injectField {
+	out := make([]injectField, 0, st.NumField())
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.PkgPath != "" || f.Type == injectType {
+			continue
+		}
+
+		out = append(out, injectField{depKey{f.Type, f.Tag.Get("remote")}, i})
+	}
+	return out
+}
+
+// requirements returns dependencies which are necessary to fill the parameter
+func requirements(rtype reflect.Type) []depKey {
+	if rtype == contextInterface || rtype == requestType || rtype == clientType || rtype == streamType {
+		return nil
+	}
+
+	if isInjectStruct(rtype) {
+		fields := injectFields(keyOf(rtype))
+		out := make([]depKey, len(fields))
+		for i := range fields {
+			out[i] = fields[i].depKey
+		}
+		return out
+	}
+
+	return []depKey{{rtype: rtype}}
+}
+
+// keyOf returns the type, which is used to store provider of the type
+func keyOf(rtype reflect.Type) reflect.Type {
+	if rtype.Kind() == reflect.Ptr {
+		return rtype.Elem()
+	}
+	return rtype
+}
+
+// adaptValue converts value to pointer or dereferences it, to match the required type
+func adaptValue(val reflect.Value, rtype reflect.Type) reflect.Value {
+	if !val.IsValid() || val.Type() == rtype {
+		return val
+	}
+
+	if val.Kind() == reflect.Ptr && val.Type().Elem() == rtype {
+		if val.IsNil() {
+			return reflect.Zero(rtype)
+		}
+		return val.Elem()
+	}
+
+	if rtype.Kind() == reflect.Ptr && rtype.Elem() == val.Type() {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		return ptr
 	}
 
-	return out[0], true, nil
+	return val
 }
@@ -0,0 +1,425 @@
+package go_remote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type stubUser struct {
+	Name string
+}
+
+type stubSession struct {
+	User string
+}
+
+func TestAddProviderShapes(t *testing.T) {
+	request := &http.Request{Method: "POST"}
+	client := &Client{User: 42}
+
+	tests := []struct {
+		name     string
+		provider interface{}
+		expected string
+	}{
+		{"value", func() stubSession { return stubSession{"a"} }, "a"},
+		{"pointer", func() *stubSession { return &stubSession{"b"} }, "b"},
+		{"context", func(ctx context.Context) stubSession { return stubSession{"c"} }, "c"},
+		{"error", func(ctx context.Context) (stubSession, error) { return stubSession{"d"}, nil }, "d"},
+		{"cleanup", func() (stubSession, func()) { return stubSession{"e"}, func() {} }, "e"},
+		{"cleanup and error", func() (*stubSession, func(), error) { return &stubSession{"f"}, func() {}, nil }, "f"},
+		{"request", func(r *http.Request) stubSession { return stubSession{r.Method} }, "POST"},
+		{"client", func(c *Client) stubSession {
+			if c == nil {
+				return stubSession{}
+			}
+			return stubSession{"client"}
+		}, "client"},
+		{"dependency", func(ctx context.Context, u *stubUser) stubSession { return stubSession{u.Name} }, "alex"},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		if err := d.AddProvider(func() stubUser { return stubUser{"alex"} }); err != nil {
+			t.Fatalf("%s: can't add user provider, %s", test.name, err)
+		}
+		if err := d.AddProvider(test.provider); err != nil {
+			t.Errorf("%s: valid provider was rejected, %s", test.name, err)
+			continue
+		}
+
+		ctx := context.WithValue(context.Background(), RequestValue, request)
+		ctx = context.WithValue(ctx, ClientValue, client)
+		ctx = withDependencyScope(ctx, CallScope)
+
+		val, ok, err := d.Value(reflect.TypeOf(stubSession{}), ctx)
+		if !ok || err != nil {
+			t.Errorf("%s: value was not resolved, %v", test.name, err)
+			continue
+		}
+		if val.Interface().(stubSession).User != test.expected {
+			t.Errorf("%s: incorrect value %+v", test.name, val.Interface())
+		}
+	}
+}
+
+func TestAddProviderInvalidShapes(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider interface{}
+	}{
+		{"not a function", stubSession{}},
+		{"nil", nil},
+		{"no results", func() {}},
+		{"error only", func() error { return nil }},
+		{"cleanup only", func() func() { return nil }},
+		{"invalid second result", func() (stubSession, int) { return stubSession{}, 0 }},
+		{"invalid order", func() (stubSession, error, func()) { return stubSession{}, nil, nil }},
+		{"too many results", func() (stubSession, func(), error, int) { return stubSession{}, nil, nil, 0 }},
+		{"variadic", func(args ...int) stubSession { return stubSession{} }},
+		{"error parameter", func(err error) stubSession { return stubSession{} }},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		if err := d.AddProvider(test.provider); err == nil {
+			t.Errorf("%s: invalid provider was accepted", test.name)
+		}
+	}
+}
+
+func TestProviderErrors(t *testing.T) {
+	d := newDependencyStore()
+	expected := errors.New("expected error")
+	d.AddProvider(func() (*stubSession, error) { return nil, expected })
+
+	_, ok, err := d.Value(reflect.TypeOf(stubSession{}), context.Background())
+	if !ok || err != expected {
+		t.Errorf("provider error was not returned, %v", err)
+	}
+
+	_, ok, _ = d.Value(reflect.TypeOf(stubUser{}), context.Background())
+	if ok {
+		t.Errorf("missing provider was resolved")
+	}
+
+	d.AddProvider(func(s stubSession) stubUser { return stubUser{} })
+	if err := d.AddProvider(func(u stubUser) stubSession { return stubSession{} }); err == nil {
+		t.Errorf("circular dependency was accepted")
+	}
+}
+
+func TestProviderScopes(t *testing.T) {
+	user := func() stubUser { return stubUser{} }
+	session := func(u stubUser) stubSession { return stubSession{} }
+
+	type scoped struct {
+		fn    interface{}
+		scope Scope
+	}
+	tests := []struct {
+		name      string
+		providers []scoped
+		valid     bool
+	}{
+		{"same scope", []scoped{{user, BatchScope}, {session, BatchScope}}, true},
+		{"longer dependency", []scoped{{user, SingletonScope}, {session, CallScope}}, true},
+		{"shorter dependency", []scoped{{user, CallScope}, {session, SingletonScope}}, false},
+		{"shorter dependency added later", []scoped{{session, ConnectionScope}, {user, BatchScope}}, false},
+		{"request in connection", []scoped{{func(r *http.Request) stubSession { return stubSession{} }, ConnectionScope}}, true},
+		{"request in singleton", []scoped{{func(r *http.Request) stubSession { return stubSession{} }, SingletonScope}}, false},
+		{"client in singleton", []scoped{{func(c *Client) stubSession { return stubSession{} }, SingletonScope}}, false},
+		{"context in singleton", []scoped{{func(ctx context.Context) stubSession { return stubSession{} }, SingletonScope}}, false},
+		{"stream in batch", []scoped{{func(s *Stream) stubSession { return stubSession{} }, BatchScope}}, false},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		var err error
+		for _, p := range test.providers {
+			err = d.AddScopedProvider(p.fn, p.scope)
+		}
+
+		if test.valid && err != nil {
+			t.Errorf("%s: valid provider was rejected, %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: invalid provider was accepted", test.name)
+		}
+		if !test.valid && len(d.data) != len(test.providers)-1 {
+			t.Errorf("%s: invalid provider was not removed", test.name)
+		}
+	}
+}
+
+func TestProviderFailuresAreNotCached(t *testing.T) {
+	expected := errors.New("expected error")
+	tests := []struct {
+		name string
+		fail func() (*stubSession, error)
+	}{
+		{"error", func() (*stubSession, error) { return nil, expected }},
+		{"panic", func() (*stubSession, error) { panic("expected panic") }},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		calls := 0
+		d.AddScopedProvider(func() (*stubSession, error) {
+			calls++
+			if calls == 1 {
+				return test.fail()
+			}
+			return &stubSession{User: "ok"}, nil
+		}, SingletonScope)
+
+		_, _, err := d.Value(reflect.TypeOf(stubSession{}), context.Background())
+		if err == nil {
+			t.Errorf("%s: failure was not returned", test.name)
+		}
+
+		val, _, err := d.Value(reflect.TypeOf(stubSession{}), context.Background())
+		if err != nil || val.Interface().(stubSession).User != "ok" {
+			t.Errorf("%s: failure was cached, %v", test.name, err)
+		}
+
+		d.Value(reflect.TypeOf(stubSession{}), context.Background())
+		if calls != 2 {
+			t.Errorf("%s: successful value was not cached, %d calls", test.name, calls)
+		}
+	}
+}
+
+func TestRefreshReplacesCachedValue(t *testing.T) {
+	d := newDependencyStore()
+	calls := 0
+	closed := 0
+	d.AddScopedProvider(func() (stubUser, func()) {
+		calls++
+		return stubUser{Name: string(rune('a' + calls - 1))}, func() { closed++ }
+	}, ConnectionScope)
+
+	ctx := withDependencyScope(context.Background(), ConnectionScope)
+	rtype := reflect.TypeOf(stubUser{})
+	d.Value(rtype, ctx)
+
+	val, _, err := d.refresh(rtype, ctx)
+	if err != nil || val.Interface().(stubUser).Name != "b" {
+		t.Fatalf("value was not refreshed, %v", err)
+	}
+	if closed != 1 {
+		t.Errorf("previous value was not released")
+	}
+
+	val, _, _ = d.Value(rtype, ctx)
+	if val.Interface().(stubUser).Name != "b" || calls != 2 {
+		t.Errorf("refreshed value was not cached, %v", val.Interface())
+	}
+
+	closeDependencyScope(ctx, ConnectionScope)
+	if closed != 2 {
+		t.Errorf("expected both values to be released, got %d", closed)
+	}
+}
+
+type stubCloser struct {
+	name string
+	log  *[]string
+}
+
+func (c *stubCloser) Close() error {
+	*c.log = append(*c.log, c.name)
+	return nil
+}
+
+type stubConnection struct {
+	*stubCloser
+}
+
+type stubNamer interface {
+	GetName() string
+}
+
+func (s stubSession) GetName() string {
+	return s.User
+}
+
+func (u stubUser) GetName() string {
+	return u.Name
+}
+
+type stubDatabases struct {
+	Inject
+	Primary *stubUser `remote:"primary"`
+	Replica stubUser  `remote:"replica"`
+	Namer   stubNamer
+}
+
+func TestScopeCaching(t *testing.T) {
+	tests := []struct {
+		scope    Scope
+		expected int
+	}{
+		{CallScope, 4},
+		{BatchScope, 3},
+		{ConnectionScope, 2},
+		{SingletonScope, 1},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		calls := 0
+		d.AddScopedProvider(func() stubUser {
+			calls++
+			return stubUser{}
+		}, test.scope)
+
+		conn := withDependencyScope(context.Background(), ConnectionScope)
+		batch := withDependencyScope(conn, BatchScope)
+		call := withDependencyScope(batch, CallScope)
+		contexts := []context.Context{
+			call,
+			call,
+			withDependencyScope(batch, CallScope),
+			withDependencyScope(withDependencyScope(conn, BatchScope), CallScope),
+			withDependencyScope(withDependencyScope(withDependencyScope(context.Background(), ConnectionScope), BatchScope), CallScope),
+		}
+		for _, ctx := range contexts {
+			d.Value(reflect.TypeOf(stubUser{}), ctx)
+		}
+
+		if calls != test.expected {
+			t.Errorf("scope %d: expected %d calls, got %d", test.scope, test.expected, calls)
+		}
+	}
+}
+
+func TestScopeCleanup(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider interface{}
+		expected []string
+	}{
+		{"cleanup", func(c *stubCloser) (stubSession, func()) {
+			return stubSession{}, func() { *c.log = append(*c.log, "session") }
+		}, []string{"session", "closer"}},
+		{"closer", func(c *stubCloser) stubConnection {
+			return stubConnection{&stubCloser{name: "connection", log: c.log}}
+		}, []string{"connection", "closer"}},
+		{"panic in cleanup", func(c *stubCloser) (stubSession, func()) {
+			return stubSession{}, func() { panic("expected panic") }
+		}, []string{"closer"}},
+		{"error", func(c *stubCloser) (stubSession, func(), error) {
+			return stubSession{}, func() { *c.log = append(*c.log, "session") }, errors.New("expected error")
+		}, []string{"closer"}},
+		{"panic", func(c *stubCloser) stubSession {
+			panic("expected panic")
+		}, []string{"closer"}},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		log := make([]string, 0)
+		d.AddProvider(func() *stubCloser { return &stubCloser{name: "closer", log: &log} })
+		if err := d.AddProvider(test.provider); err != nil {
+			t.Fatalf("%s: provider was rejected, %v", test.name, err)
+		}
+
+		ctx := withDependencyScope(context.Background(), CallScope)
+		d.Value(reflect.TypeOf(test.provider).Out(0), ctx)
+		closeDependencyScope(ctx, CallScope)
+
+		if !reflect.DeepEqual(log, test.expected) {
+			t.Errorf("%s: incorrect cleanup order %v", test.name, log)
+		}
+	}
+}
+
+func TestInjectDependencies(t *testing.T) {
+	primary := func() *stubUser { return &stubUser{"primary"} }
+	replica := func() stubUser { return stubUser{"replica"} }
+	session := func() stubSession { return stubSession{"session"} }
+
+	type named struct {
+		name string
+		fn   interface{}
+	}
+	tests := []struct {
+		name      string
+		providers []named
+		valid     bool
+	}{
+		{"all fields", []named{{"primary", primary}, {"replica", replica}, {"", session}}, true},
+		{"missing named", []named{{"primary", primary}, {"", session}}, false},
+		{"unnamed instead of named", []named{{"", primary}, {"replica", replica}, {"", session}}, false},
+		{"missing interface", []named{{"primary", primary}, {"replica", replica}}, false},
+		{"ambiguous interface", []named{{"primary", primary}, {"replica", replica}, {"", session}, {"", func() stubUser { return stubUser{} }}}, false},
+	}
+
+	for _, test := range tests {
+		d := newDependencyStore()
+		for _, p := range test.providers {
+			d.AddNamedProvider(p.name, p.fn, CallScope)
+		}
+
+		val, ok, err := d.Value(reflect.TypeOf(stubDatabases{}), context.Background())
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: invalid dependencies were resolved", test.name)
+			}
+			continue
+		}
+
+		if !ok || err != nil {
+			t.Errorf("%s: dependencies were not resolved, %v", test.name, err)
+			continue
+		}
+		db := val.Interface().(stubDatabases)
+		if db.Primary.Name != "primary" || db.Replica.Name != "replica" || db.Namer.GetName() != "session" {
+			t.Errorf("%s: incorrect dependencies %+v", test.name, db)
+		}
+	}
+}
+
+type ReleaseService struct{}
+
+func (ReleaseService) Done(c *stubCloser) string {
+	return "ok"
+}
+
+func (ReleaseService) Fail(c *stubCloser) error {
+	return errors.New("failed")
+}
+
+func (ReleaseService) Panic(c *stubCloser) error {
+	panic("expected panic")
+}
+
+func TestScopeReleaseAfterCall(t *testing.T) {
+	tests := []struct {
+		call  string
+		error string
+	}{
+		{`[{"id":"1","name":"release.Done","args":[]}]`, ""},
+		{`[{"id":"1","name":"release.Fail","args":[]}]`, "failed"},
+		{`[{"id":"1","name":"release.Panic","args":[]}]`, "Method call error"},
+	}
+
+	for _, test := range tests {
+		log := make([]string, 0)
+		s := NewServer(nil)
+		s.AddService("release", ReleaseService{})
+		s.Dependencies.AddProvider(func() *stubCloser { return &stubCloser{name: "call", log: &log} })
+
+		res := s.Process([]byte(test.call), context.Background())
+		if len(res) != 1 || res[0].Error != test.error {
+			t.Errorf("%s: incorrect result %+v", test.call, res)
+		}
+		if !reflect.DeepEqual(log, []string{"call"}) {
+			t.Errorf("%s: call value was not released, %v", test.call, log)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package go_remote
+
+import "time"
+
+// HistoryConfig defines which of the published messages are stored for the channel
+type HistoryConfig struct {
+	// Size is a max count of stored messages, default is 100
+	Size int
+	// MaxAge is a max age of stored messages, 0 means no limit
+	MaxAge time.Duration
+}
+
+// ReplayOptions selects stored messages, which are sent to a new subscriber
+type ReplayOptions struct {
+	// Since selects messages with a greater sequence number
+	Since int64 `json:"since"`
+	// After selects messages published after the timestamp ( unix time in milliseconds )
+	After int64 `json:"after"`
+}
+
+const defaultHistorySize = 100
+
+type history struct {
+	config   HistoryConfig
+	messages []Message
+}
+
+func newHistory(config HistoryConfig) *history {
+	if config.Size <= 0 {
+		config.Size = defaultHistorySize
+	}
+
+	return &history{config: config}
+}
+
+func (h *history) add(m Message) {
+	h.messages = append(h.messages, m)
+	if len(h.messages) > h.config.Size {
+		h.messages = h.messages[len(h.messages)-h.config.Size:]
+	}
+
+	h.trim(m.Time)
+}
+
+// trim removes messages, which are older than allowed
+func (h *history) trim(now time.Time) {
+	if h.config.MaxAge <= 0 {
+		return
+	}
+
+	limit := now.Add(-h.config.MaxAge)
+	i := 0
+	for i < len(h.messages) && h.messages[i].Time.Before(limit) {
+		i++
+	}
+	h.messages = h.messages[i:]
+}
+
+// find returns stored messages, which match replay options
+func (h *history) find(opts *ReplayOptions) []Message {
+	h.trim(time.Now())
+
+	after := time.Unix(0, opts.After*int64(time.Millisecond))
+	out := make([]Message, 0)
+	for _, m := range h.messages {
+		if m.Seq > opts.Since && (opts.After == 0 || m.Time.After(after)) {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
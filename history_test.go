@@ -0,0 +1,120 @@
+package go_remote
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistoryFind(t *testing.T) {
+	now := time.Now()
+	millis := func(d time.Duration) int64 {
+		return now.Add(-d).UnixNano() / int64(time.Millisecond)
+	}
+
+	tests := []struct {
+		name     string
+		config   HistoryConfig
+		replay   ReplayOptions
+		expected []int64
+	}{
+		{"all", HistoryConfig{}, ReplayOptions{}, []int64{1, 2, 3, 4, 5}},
+		{"since", HistoryConfig{}, ReplayOptions{Since: 3}, []int64{4, 5}},
+		{"since last", HistoryConfig{}, ReplayOptions{Since: 5}, []int64{}},
+		{"after", HistoryConfig{}, ReplayOptions{After: millis(150 * time.Second)}, []int64{4, 5}},
+		{"since and after", HistoryConfig{}, ReplayOptions{Since: 4, After: millis(10 * time.Minute)}, []int64{5}},
+		{"max age", HistoryConfig{MaxAge: 210 * time.Second}, ReplayOptions{}, []int64{3, 4, 5}},
+		{"size", HistoryConfig{Size: 2}, ReplayOptions{}, []int64{4, 5}},
+	}
+
+	for _, test := range tests {
+		h := newHistory(test.config)
+		for i := int64(1); i <= 5; i++ {
+			h.add(Message{Seq: i, Time: now.Add(time.Duration(i-6) * time.Minute)})
+		}
+
+		seqs := make([]int64, 0)
+		for _, m := range h.find(&test.replay) {
+			seqs = append(seqs, m.Seq)
+		}
+		if !reflect.DeepEqual(seqs, test.expected) {
+			t.Errorf("%s: incorrect messages %v", test.name, seqs)
+		}
+	}
+}
+
+func TestHistoryDefaultSize(t *testing.T) {
+	h := newHistory(HistoryConfig{})
+	for i := 0; i < defaultHistorySize*2; i++ {
+		h.add(Message{Seq: int64(i), Time: time.Now()})
+	}
+
+	if len(h.messages) != defaultHistorySize {
+		t.Errorf("history without size is not limited, %d messages", len(h.messages))
+	}
+}
+
+func TestHubFindHistory(t *testing.T) {
+	hub := NewServer(nil).Events
+	hub.AddHistory("orders.a", HistoryConfig{})
+	hub.AddHistory("orders.b", HistoryConfig{})
+	hub.AddHistory("users", HistoryConfig{})
+
+	for i, name := range []string{"orders.a", "orders.b", "users", "orders.a"} {
+		hub.histories[name].add(Message{Channel: name, Seq: int64(i + 1), Time: time.Now()})
+	}
+
+	tests := []struct {
+		name     string
+		replay   ReplayOptions
+		expected []int64
+	}{
+		{"orders.a", ReplayOptions{}, []int64{1, 4}},
+		{"orders.*", ReplayOptions{}, []int64{1, 2, 4}},
+		{"orders.*", ReplayOptions{Since: 1}, []int64{2, 4}},
+		{"unknown", ReplayOptions{}, []int64{}},
+	}
+
+	for _, test := range tests {
+		seqs := make([]int64, 0)
+		for _, m := range hub.findHistory(test.name, &test.replay) {
+			seqs = append(seqs, m.Seq)
+		}
+		if !reflect.DeepEqual(seqs, test.expected) {
+			t.Errorf("%s %+v: incorrect messages %v", test.name, test.replay, seqs)
+		}
+	}
+}
+
+func TestAddHistoryWhileRunning(t *testing.T) {
+	hub := NewServer(&ServerConfig{WebSocket: true}).Events
+	defer hub.Stop()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			hub.Publish("orders", i)
+		}
+		close(done)
+	}()
+	hub.AddHistory("orders", HistoryConfig{})
+	<-done
+
+	// listeners are notified after the message is stored
+	out := make(chan Message, 200)
+	hub.SubscribeChan("orders", out)
+	hub.Publish("orders", "last")
+	for m := range out {
+		if m.Content == "last" {
+			break
+		}
+	}
+
+	messages := make([]Message, 0)
+	hub.do(func() {
+		messages = hub.findHistory("orders", &ReplayOptions{})
+	})
+	if len(messages) == 0 {
+		t.Errorf("messages are not stored")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,27 +16,33 @@ type key int
 
 var UserValue = key(1)
 var ConnectionValue = key(2)
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+var RequestValue = key(3)
+var ClientValue = key(4)
 
 type StatusInfo struct {
 	Hub HubStatus
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.isClosing() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	ctx, err := s.Connect(r)
 	if err != nil {
 		serveError(w, err)
 		return
 	}
+	ctx = context.WithValue(ctx, RequestValue, r)
+	ctx = withDependencyScope(ctx, ConnectionScope)
 
 	isSocketStart := r.Method == "GET" && r.URL.Query().Get("ws") != ""
+	if !isSocketStart {
+		// websocket client releases the scope on disconnect
+		defer closeDependencyScope(ctx, ConnectionScope)
+	}
+
 	if r.Method == "GET" && !isSocketStart {
 		serveJSON(w, s.GetAPI(ctx))
 		return
@@ -46,7 +54,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isSocketStart {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			serveError(w, err)
 			return
@@ -55,12 +63,68 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		userID, _ := ctx.Value(UserValue).(int)
 		cid, cidExists := ctx.Value(ConnectionValue).(int)
 		if !cidExists {
-			cid := nextId()
+			cid = int(nextId())
 			ctx = context.WithValue(ctx, ConnectionValue, cid)
 		}
 
-		client := Client{Server: s, conn: conn, Send: make(chan []byte, 256), User: userID, ConnID: cid }
-		client.ctx = ctx
+		if !s.track(&s.connections) {
+			rejectSocket(conn, websocket.CloseGoingAway, "server is shutting down")
+			closeDependencyScope(ctx, ConnectionScope)
+			return
+		}
+
+		queue, ok := ctx.Value(queueConfigValue).(QueueConfig)
+		if !ok {
+			queue = s.config.Queue
+		}
+		limits, ok := ctx.Value(socketConfigValue).(SocketConfig)
+		if !ok {
+			limits = s.config.Socket
+		}
+
+		client := Client{Server: s, conn: conn, Send: make(chan []byte, 256), User: userID, ConnID: cid}
+		// context of the request is cancelled when ServeHTTP returns, so the client context
+		// keeps only its values and is cancelled when the connection is released
+		ctx, client.cancel = context.WithCancel(detachedContext{ctx})
+		client.ctx = context.WithValue(ctx, ClientValue, &client)
+		client.queue = newSendQueue(queue, &s.Events.dropped)
+		client.closing = make(chan []byte, 1)
+		client.done = make(chan struct{})
+		client.calls = newClientCalls()
+		client.streams = newStreamRegistry()
+		client.limits = normalizeSocketConfig(limits)
+		client.subscriptions = newSubscriptionSet()
+		client.pool = newWorkerPool(client.limits.Pool)
+
+		query := r.URL.Query()
+		if query.Get("resume") != "" || query.Get("reliable") != "" {
+			var old *Client
+			client.reliable = query.Get("reliable") != ""
+			client.session, old = s.sessions.open(query.Get("session"), &client, client.reliable)
+			if old != nil {
+				// connection scope of the previous connection is used instead of the new one
+				closeDependencyScope(ctx, ConnectionScope)
+				client.ConnID = old.ConnID
+				client.cancel()
+				client.ctx = context.WithValue(old.ctx, ClientValue, &client)
+				client.cancel = old.cancel
+				client.subscriptions = old.subscriptions.copy()
+				go client.resume(old)
+				return
+			}
+		}
+
+		// resumed session replaces the previous connection, so only new connections are counted
+		if !s.Events.connectLimited(&client, limits.MaxUserConnections) {
+			if client.session != nil {
+				s.sessions.remove(client.session)
+			}
+			rejectSocket(conn, CloseTooManyConnections, "too many connections")
+			closeDependencyScope(ctx, ConnectionScope)
+			client.cancel()
+			s.connections.Done()
+			return
+		}
 
 		go client.Start()
 		return
@@ -71,14 +135,66 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError(w, err)
 		return
 	}
+	if r.Header.Get("Accept") == "application/x-ndjson" {
+		s.serveStream(w, r, body, ctx)
+		return
+	}
+
 	res := s.Process(body, ctx)
 	serveJSON(w, res)
 }
 
+// serveStream writes parts of streamed results and responses of calls as lines of JSON
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, body []byte, ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// client disconnect cancels streams, even when Connect doesn't use context of the request
+	done := ctx.Done()
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	w.Header().Set("Content-type", "application/x-ndjson")
+	stream := &httpStream{w: w, cancel: cancel}
+	ctx = context.WithValue(ctx, streamTransportValue, stream)
+
+	s.ProcessEach(body, ctx, func(res *Response) {
+		stream.writeLine(res)
+	})
+}
+
 func (s *Server) ServeStatus(w http.ResponseWriter, _ *http.Request) {
 	serveJSON(w, StatusInfo{Hub: *s.Events.Status()})
 }
 
+// detachedContext has values of the parent context, but is never cancelled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// rejectSocket closes the new websocket connection with the code
+func rejectSocket(conn *websocket.Conn, code int, text string) {
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	conn.Close()
+}
+
 func serveError(w http.ResponseWriter, err error) {
 	text := err.Error()
 	log.Errorf(text)
@@ -91,9 +207,8 @@ func serveJSON(w http.ResponseWriter, res interface{}) {
 	w.Write(out)
 }
 
-var idCounter ConnectionID
+var idCounter int64
 
 func nextId() ConnectionID {
-	idCounter += 1
-	return idCounter
+	return ConnectionID(atomic.AddInt64(&idCounter, 1))
 }
@@ -2,38 +2,86 @@ package go_remote
 
 import (
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Message struct {
 	Channel string      `json:"name"`
 	Content interface{} `json:"value"`
+	Seq     int64       `json:"seq"`
+	Time    time.Time   `json:"-"`
 	Clients []ConnectionID
+
+	// Users limits delivery to connections of the listed users
+	Users []int `json:"-"`
+	// Except excludes the connection from delivery
+	Except ConnectionID `json:"-"`
+	// Broadcast delivers the message to all connections, regardless of subscriptions
+	Broadcast bool `json:"-"`
+	// Sender is set for messages, published by a client
+	Sender *MessageSender `json:"sender,omitempty"`
 }
 
 type subscription struct {
 	Client  *Client
 	Channel string
 	Mode    bool
+	Replay  *ReplayOptions
+
+	done chan bool
 }
 
 type UserChange struct {
 	ID         int  `json:"id"`
 	Connection int  `json:"-"`
 	Status     bool `json:"status"`
+
+	client *Client
 }
 
 type HubStatus struct {
+	// Users contains count of connections per user
 	Users    map[int]int
 	Channels map[string]ChannelStatus
+	Patterns map[string]ChannelStatus
+	Clients  []ClientStatus
+
+	Published    uint64
+	Delivered    uint64
+	Dropped      uint64
+	PublishRate  float64
+	DeliveryRate float64
+	PublishQueue int
 }
 
 type ChannelStatus struct {
-	Subscribed []int
+	Subscribed  []int
+	Connections []ConnectionID
+}
+
+// ClientStatus describes a single websocket connection
+type ClientStatus struct {
+	ID      ConnectionID
+	User    int
+	Queue   int
+	Dropped uint64
 }
 
+const publishQueueSize = 256
+
+// UserHandler is called when a user connects or disconnects, handlers are called
+// outside of the hub loop, in the order of changes, so they can use methods of the hub
 type UserHandler func(u *UserChange)
+
+// ChannelGuard is called inside of the hub loop, so it must not call methods of the hub
 type ChannelGuard func(*Message, *Client) bool
 
+// SubscribeGuard allows or denies subscription of the client to the channel
+type SubscribeGuard func(channel string, c *Client) bool
+
 type channel struct {
 	clients map[*Client]bool
 }
@@ -43,12 +91,34 @@ type Hub struct {
 	ConnHandler UserHandler
 
 	users    map[int]int
+	clients  map[*Client]bool
 	channels map[string]channel
+	patterns *patternNode
 	filters  map[string]ChannelGuard
+	guards   map[string]SubscribeGuard
+
+	publishGuards   map[string]PublishGuard
+	publishHandlers []publishHandler
+
+	seq       int64
+	dropped   uint64
+	published rateCounter
+	delivered rateCounter
+	running   int32
+	// direct is locked by the hub loop, functions executed without the loop use it as well
+	direct    sync.Mutex
+	handlers  handlerQueue
+	histories map[string]*history
+	presence  map[string]*presenceChannel
+	meta      map[*Client]interface{}
+	listeners map[*listener]bool
 
 	publish   chan Message
 	subscribe chan subscription
 	register  chan UserChange
+	commands  chan func()
+	done      chan struct{}
+	stopOnce  sync.Once
 }
 
 func newHub() *Hub {
@@ -56,33 +126,105 @@ func newHub() *Hub {
 		UserHandler: func(u *UserChange) {},
 		ConnHandler: func(u *UserChange) {},
 
-		publish:   make(chan Message),
+		publish:   make(chan Message, publishQueueSize),
 		subscribe: make(chan subscription),
 		register:  make(chan UserChange),
-
-		filters:  make(map[string]ChannelGuard),
-		channels: make(map[string]channel),
-		users:    make(map[int]int),
+		commands:  make(chan func()),
+		done:      make(chan struct{}),
+
+		filters:   make(map[string]ChannelGuard),
+		guards:    make(map[string]SubscribeGuard),
+		channels:  make(map[string]channel),
+		patterns:  newPatternNode(),
+		users:     make(map[int]int),
+		clients:   make(map[*Client]bool),
+		histories: make(map[string]*history),
+		presence:  make(map[string]*presenceChannel),
+		meta:      make(map[*Client]interface{}),
+		listeners: make(map[*listener]bool),
+
+		publishGuards: make(map[string]PublishGuard),
 	}
 }
 
+// Status returns a snapshot of the hub state
 func (h *Hub) Status() *HubStatus {
-	info := make(map[string]ChannelStatus)
+	out := &HubStatus{}
+	h.do(func() {
+		now := time.Now()
+		out.Users = make(map[int]int, len(h.users))
+		for id, count := range h.users {
+			out.Users[id] = count
+		}
 
-	for name, ch := range h.channels {
-		subs := make([]int, 0, len(ch.clients))
-		for cl := range ch.clients {
-			subs = append(subs, cl.User)
+		out.Channels = make(map[string]ChannelStatus, len(h.channels))
+		for name, ch := range h.channels {
+			out.Channels[name] = channelStatus(ch.clients)
 		}
-		info[name] = ChannelStatus{Subscribed: subs}
+
+		patterns := make(map[string][]*Client)
+		h.patterns.patterns("", patterns)
+		out.Patterns = make(map[string]ChannelStatus, len(patterns))
+		for name, clients := range patterns {
+			list := make(map[*Client]bool, len(clients))
+			for _, c := range clients {
+				list[c] = true
+			}
+			out.Patterns[name] = channelStatus(list)
+		}
+
+		out.Clients = make([]ClientStatus, 0, len(h.clients))
+		for c := range h.clients {
+			queue, dropped := c.queue.status()
+			out.Clients = append(out.Clients, ClientStatus{ID: ConnectionID(c.ConnID), User: c.User, Queue: queue, Dropped: dropped})
+		}
+		sort.Slice(out.Clients, func(i, j int) bool { return out.Clients[i].ID < out.Clients[j].ID })
+
+		out.Published = h.published.total
+		out.Delivered = h.delivered.total
+		out.Dropped = atomic.LoadUint64(&h.dropped)
+		out.PublishRate = h.published.perSecond(now)
+		out.DeliveryRate = h.delivered.perSecond(now)
+		out.PublishQueue = len(h.publish)
+	})
+
+	return out
+}
+
+func channelStatus(clients map[*Client]bool) ChannelStatus {
+	info := ChannelStatus{
+		Subscribed:  make([]int, 0, len(clients)),
+		Connections: make([]ConnectionID, 0, len(clients)),
 	}
-	return &HubStatus{
-		Users:    h.users,
-		Channels: info,
+	for c := range clients {
+		info.Subscribed = append(info.Subscribed, c.User)
+		info.Connections = append(info.Connections, ConnectionID(c.ConnID))
 	}
+	sort.Ints(info.Subscribed)
+	sort.Slice(info.Connections, func(i, j int) bool { return info.Connections[i] < info.Connections[j] })
+
+	return info
+}
+
+// Stop finishes the hub loop, messages sent to the stopped hub are ignored
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// start marks the hub as running before the loop is started, so commands,
+// sent right after the start, are never executed outside of the loop
+func (h *Hub) start() {
+	atomic.StoreInt32(&h.running, 1)
+	go h.Run()
 }
 
 func (h *Hub) Run() {
+	h.direct.Lock()
+	defer h.direct.Unlock()
+
+	atomic.StoreInt32(&h.running, 1)
 	for {
 		select {
 		case sub := <-h.subscribe:
@@ -91,41 +233,199 @@ func (h *Hub) Run() {
 			h.onPublish(&m)
 		case u := <-h.register:
 			h.onRegister(&u)
+		case f := <-h.commands:
+			f()
+		case <-h.done:
+			atomic.StoreInt32(&h.running, 0)
+			return
 		}
 	}
 }
 
+// AddGuard adds a filter, which is called for each client on each message of the channel
 func (h *Hub) AddGuard(name string, filter func(*Message, *Client) bool) {
 	h.filters[name] = filter
 }
 
+// AddSubscribeGuard adds a guard, which is checked once, when a client subscribes
+// to the channel, name can be a pattern to protect a group of channels.
+// Guards must be added before the server starts to accept connections
+func (h *Hub) AddSubscribeGuard(name string, guard SubscribeGuard) {
+	h.guards[name] = guard
+}
+
+// CanSubscribe checks all subscribe guards, which can match the channel name or pattern
+func (h *Hub) CanSubscribe(channel string, c *Client) bool {
+	for name, guard := range h.guards {
+		if overlapPattern(name, channel) && !guard(channel, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AddHistory enables storing of messages, published to the channel, it can be called at any time
+func (h *Hub) AddHistory(name string, config HistoryConfig) {
+	store := newHistory(config)
+	h.do(func() {
+		h.histories[name] = store
+	})
+}
+
+// Subscribe adds client to the channel, channel name can be a pattern
+// like "orders.*" or "orders.>" to receive messages of all matching channels
 func (h *Hub) Subscribe(channel string, c *Client) {
-	h.subscribe <- subscription{c, channel, true}
+	h.changeSubscription(subscription{Client: c, Channel: channel, Mode: true})
+}
+
+// SubscribeWithReplay subscribes client to the channel and sends stored messages, which match replay options
+func (h *Hub) SubscribeWithReplay(channel string, c *Client, replay *ReplayOptions) {
+	h.changeSubscription(subscription{Client: c, Channel: channel, Mode: true, Replay: replay})
 }
 
 func (h *Hub) UnSubscribe(channel string, c *Client) {
-	h.subscribe <- subscription{c, channel, false}
+	h.changeSubscription(subscription{Client: c, Channel: channel, Mode: false})
+}
+
+// changeSubscription waits till the hub applies the change,
+// so messages sent to the client after it are ordered correctly
+func (h *Hub) changeSubscription(sub subscription) {
+	sub.done = make(chan bool)
+	select {
+	case h.subscribe <- sub:
+		<-sub.done
+	case <-h.done:
+	}
+}
+
+func (h *Hub) send(m Message) {
+	select {
+	case h.publish <- m:
+	case <-h.done:
+	}
+}
+
+func (h *Hub) changeUser(u UserChange) {
+	select {
+	case h.register <- u:
+	case <-h.done:
+	}
 }
 
 func (h *Hub) Publish(name string, data interface{}, clients ...ConnectionID) {
-	h.publish <- Message{Channel: name, Content: data, Clients: clients}
+	h.send(Message{Channel: name, Content: data, Clients: clients})
+}
+
+// PublishToUsers sends message to subscribers of the channel, which belong to the users
+func (h *Hub) PublishToUsers(name string, data interface{}, users ...int) {
+	h.send(Message{Channel: name, Content: data, Users: users})
+}
+
+// PublishExcept sends message to all subscribers of the channel, except of the connection
+func (h *Hub) PublishExcept(name string, data interface{}, except ConnectionID) {
+	h.send(Message{Channel: name, Content: data, Except: except})
+}
+
+// Broadcast sends message to all connected clients, regardless of their subscriptions
+func (h *Hub) Broadcast(name string, data interface{}) {
+	h.send(Message{Channel: name, Content: data, Broadcast: true})
+}
+
+// PublishMessage sends the message, delivery is defined by fields of the message
+func (h *Hub) PublishMessage(m Message) {
+	h.send(m)
 }
 
 func (h *Hub) UserIn(id, device int) {
-	h.register <- UserChange{ID: id, Connection: device, Status: true}
+	h.changeUser(UserChange{ID: id, Connection: device, Status: true})
 }
 
 func (h *Hub) UserOut(id, conn int) {
-	h.register <- UserChange{ID: id, Connection: conn, Status: false}
+	h.changeUser(UserChange{ID: id, Connection: conn, Status: false})
+}
+
+func (h *Hub) connect(c *Client) {
+	h.changeUser(UserChange{ID: c.User, Connection: c.ConnID, Status: true, client: c})
+}
+
+func (h *Hub) disconnect(c *Client) {
+	h.changeUser(UserChange{ID: c.User, Connection: c.ConnID, Status: false, client: c})
+}
+
+// do executes the function inside of the hub loop and waits till it is completed,
+// if the hub is not running the function is executed directly, after the end of the loop
+// it must not be called from the hub loop
+func (h *Hub) do(f func()) {
+	if atomic.LoadInt32(&h.running) == 0 {
+		h.runDirect(f)
+		return
+	}
+
+	done := make(chan bool)
+	command := func() {
+		f()
+		close(done)
+	}
+
+	select {
+	case h.commands <- command:
+		<-done
+	case <-h.done:
+		h.runDirect(f)
+	}
+}
+
+func (h *Hub) runDirect(f func()) {
+	h.direct.Lock()
+	defer h.direct.Unlock()
+
+	f()
+}
+
+// connectLimited registers the client, unless the user already has max connections, zero max means no limit,
+// the check and the registration are done in one step of the hub loop
+func (h *Hub) connectLimited(c *Client, max int) bool {
+	ok := true
+	h.do(func() {
+		if max > 0 && c.User != 0 && h.users[c.User] >= max {
+			ok = false
+			return
+		}
+		h.onRegister(&UserChange{ID: c.User, Connection: c.ConnID, Status: true, client: c})
+	})
+
+	return ok
+}
+
+// findClients returns connected clients, which pass the filter
+func (h *Hub) findClients(filter func(c *Client) bool) []*Client {
+	out := make([]*Client, 0)
+	h.do(func() {
+		for c := range h.clients {
+			if filter(c) {
+				out = append(out, c)
+			}
+		}
+	})
+
+	return out
 }
 
 func (h *Hub) onSubscribe(sub *subscription) {
+	if sub.done != nil {
+		defer close(sub.done)
+	}
+
 	if !sub.Mode {
 		if sub.Channel == "" {
 			//unsubscribe from all
 			for name := range h.channels {
 				h.onUnSubscribe(name, sub.Client)
 			}
+			h.patterns.removeClient(sub.Client)
+		} else if isPattern(sub.Channel) {
+			h.patterns.remove(sub.Channel, sub.Client)
 		} else {
 			h.onUnSubscribe(sub.Channel, sub.Client)
 		}
@@ -133,59 +433,159 @@ func (h *Hub) onSubscribe(sub *subscription) {
 		return
 	}
 
-	ch, ok := h.channels[sub.Channel]
-	if !ok {
-		ch = channel{clients: make(map[*Client]bool)}
-		h.channels[sub.Channel] = ch
+	if isPattern(sub.Channel) {
+		h.patterns.add(sub.Channel, sub.Client)
+	} else {
+		ch, ok := h.channels[sub.Channel]
+		if !ok {
+			ch = channel{clients: make(map[*Client]bool)}
+			h.channels[sub.Channel] = ch
+		}
+
+		ch.clients[sub.Client] = true
+		h.joinPresence(sub.Channel, sub.Client)
 	}
 
-	ch.clients[sub.Client] = true
+	if sub.Replay != nil {
+		for _, m := range h.findHistory(sub.Channel, sub.Replay) {
+			if h.canReceive(&m, sub.Client) {
+				sub.Client.SendMessage("event", &m)
+			}
+		}
+	}
 }
 
-func (h *Hub) onUnSubscribe(channel string, client *Client) {
-	ch, ok := h.channels[channel]
-	if !ok {
-		return
+// findHistory returns stored messages of all channels, which match the name
+func (h *Hub) findHistory(name string, replay *ReplayOptions) []Message {
+	if !isPattern(name) {
+		if store, ok := h.histories[name]; ok {
+			return store.find(replay)
+		}
+		return nil
+	}
+
+	out := make([]Message, 0)
+	for channel, store := range h.histories {
+		if matchPattern(name, channel) {
+			out = append(out, store.find(replay)...)
+		}
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
 
-	delete(ch.clients, client)
-	if len(ch.clients) == 0 {
-		delete(h.channels, channel)
+	return out
+}
+
+func (h *Hub) onUnSubscribe(channel string, client *Client) {
+	if ch, ok := h.channels[channel]; ok {
+		delete(ch.clients, client)
+		if len(ch.clients) == 0 {
+			delete(h.channels, channel)
+		}
 	}
+
+	// client is removed first, so it doesn't receive its own leave event
+	h.leavePresence(channel, client)
 }
 
 func (h *Hub) onPublish(m *Message) {
-	ch, ok := h.channels[m.Channel]
-	filter, hasFilter := h.filters[m.Channel]
+	h.seq += 1
+	m.Seq = h.seq
+	m.Time = time.Now()
+	h.published.add(m.Time, 1)
+
+	if store, ok := h.histories[m.Channel]; ok {
+		store.add(*m)
+	}
+	h.notifyListeners(m)
+
+	recipients := h.clients
+	if !m.Broadcast {
+		recipients = h.recipients(m.Channel)
+	}
 
-	if ok {
+	var count uint64
+	for c := range recipients {
+		if h.canReceive(m, c) {
+			c.SendMessage("event", m)
+			count += 1
+		}
+	}
+	h.delivered.add(m.Time, count)
+}
+
+// recipients returns clients, subscribed to the channel directly or through patterns
+func (h *Hub) recipients(name string) map[*Client]bool {
+	out := make(map[*Client]bool)
+	if ch, ok := h.channels[name]; ok {
 		for c := range ch.clients {
-			if !hasFilter || filter(m, c) {
-				if len(m.Clients) != 0 {
-					for _, x := range m.Clients {
-						if x == ConnectionID(c.ConnID) {
-							c.SendMessage("event", m)
-						}
-					}
-				} else {
-					c.SendMessage("event", m)
-				}
-			}
+			out[c] = true
+		}
+	}
+
+	h.patterns.match(name, func(c *Client) {
+		out[c] = true
+	})
+
+	return out
+}
+
+// canReceive checks whether the message can be delivered to the client,
+// guards are applied by the concrete channel name of the message
+func (h *Hub) canReceive(m *Message, c *Client) bool {
+	if filter, ok := h.filters[m.Channel]; ok && !filter(m, c) {
+		return false
+	}
+
+	if m.Except != 0 && m.Except == ConnectionID(c.ConnID) {
+		return false
+	}
+
+	if len(m.Users) != 0 && !hasUser(m.Users, c.User) {
+		return false
+	}
+
+	if len(m.Clients) == 0 {
+		return true
+	}
+
+	for _, x := range m.Clients {
+		if x == ConnectionID(c.ConnID) {
+			return true
 		}
 	}
+	return false
+}
+
+func hasUser(users []int, id int) bool {
+	for _, x := range users {
+		if x == id {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Hub) onRegister(u *UserChange) {
+	if u.client != nil {
+		if u.Status {
+			h.clients[u.client] = true
+		} else {
+			delete(h.clients, u.client)
+			delete(h.meta, u.client)
+		}
+	}
+
+	change := *u
 	c := h.users[u.ID]
 	if u.Status {
 		if c == 0 {
-			h.UserHandler(u)
+			h.handlers.push(func() { h.UserHandler(&change) })
 		}
 
 		c += 1
 	} else {
 		if c <= 1 {
-			h.UserHandler(u)
+			h.handlers.push(func() { h.UserHandler(&change) })
 			delete(h.users, u.ID)
 			return
 		} else {
@@ -194,14 +594,84 @@ func (h *Hub) onRegister(u *UserChange) {
 	}
 
 	h.users[u.ID] = c
-	h.ConnHandler(u)
+	h.handlers.push(func() { h.ConnHandler(&change) })
+}
+
+// handlerQueue calls handlers in their own goroutine, in the order of adding,
+// the hub loop never waits for handlers
+type handlerQueue struct {
+	mu      sync.Mutex
+	calls   []func()
+	running bool
+}
+
+func (q *handlerQueue) push(f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.calls = append(q.calls, f)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *handlerQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.calls) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		f := q.calls[0]
+		q.calls = q.calls[1:]
+		q.mu.Unlock()
+
+		f()
+	}
+}
+
+// replace moves subscriptions and state of the client to its new connection
+func (h *Hub) replace(old, c *Client) {
+	if h.clients[old] {
+		delete(h.clients, old)
+		h.clients[c] = true
+	}
+	if meta, ok := h.meta[old]; ok {
+		delete(h.meta, old)
+		h.meta[c] = meta
+	}
+
+	for _, ch := range h.channels {
+		if ch.clients[old] {
+			delete(ch.clients, old)
+			ch.clients[c] = true
+		}
+	}
+	h.patterns.replace(old, c)
+
+	for _, ch := range h.presence {
+		if clients := ch.users[old.User]; clients[old] {
+			delete(clients, old)
+			clients[c] = true
+		}
+	}
 }
 
 func (h *Hub) LogState() string {
 	out := ""
-	for name, ch := range h.channels {
-		out += fmt.Sprintf("%s [%d]\n", name, len(ch.clients))
-	}
+	h.do(func() {
+		for name, ch := range h.channels {
+			out += fmt.Sprintf("%s [%d]\n", name, len(ch.clients))
+		}
+
+		patterns := make(map[string][]*Client)
+		h.patterns.patterns("", patterns)
+		for name, clients := range patterns {
+			out += fmt.Sprintf("%s [%d]\n", name, len(clients))
+		}
+	})
 
 	return out
 }
@@ -0,0 +1,92 @@
+package go_remote
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHubCallsFromHandlers(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(h *Hub)
+	}{
+		{"status", func(h *Hub) { h.Status() }},
+		{"find clients", func(h *Hub) { h.findClients(func(c *Client) bool { return true }) }},
+		{"connect", func(h *Hub) { h.connectLimited(&Client{User: 1}, 1) }},
+		{"members", func(h *Hub) { h.Members("room") }},
+		{"listen", func(h *Hub) { h.SubscribeChan("room", make(chan Message, 1)).Unsubscribe() }},
+	}
+
+	for _, test := range tests {
+		h := NewServer(&ServerConfig{WebSocket: true}).Events
+		done := make(chan bool, 1)
+		h.UserHandler = func(u *UserChange) {
+			test.call(h)
+			done <- true
+		}
+
+		go h.UserIn(1, 1)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("%s: call from the handler is blocked", test.name)
+		}
+		h.Stop()
+	}
+}
+
+func TestHubHandlersOrder(t *testing.T) {
+	h := NewServer(&ServerConfig{WebSocket: true}).Events
+	defer h.Stop()
+
+	changes := make(chan string, 10)
+	h.UserHandler = func(u *UserChange) {
+		time.Sleep(time.Millisecond)
+		changes <- fmt.Sprintf("user %d %v", u.ID, u.Status)
+	}
+	h.ConnHandler = func(u *UserChange) {
+		changes <- fmt.Sprintf("conn %d %v", u.Connection, u.Status)
+	}
+
+	h.UserIn(1, 10)
+	h.UserIn(1, 11)
+	h.UserOut(1, 11)
+	h.UserOut(1, 10)
+
+	expected := []string{"user 1 true", "conn 10 true", "conn 11 true", "conn 11 false", "user 1 false"}
+	for _, e := range expected {
+		select {
+		case c := <-changes:
+			if c != e {
+				t.Errorf("expected %q, got %q", e, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler is not called for %q", e)
+		}
+	}
+}
+
+func TestHubAfterStop(t *testing.T) {
+	h := NewServer(&ServerConfig{WebSocket: true}).Events
+	h.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.SubscribeChan("room", make(chan Message, 1))
+		}()
+	}
+	wg.Wait()
+
+	if len(h.listeners) != 10 {
+		t.Errorf("commands after stop are lost, %d listeners", len(h.listeners))
+	}
+	if !reflect.DeepEqual(h.Status().Users, map[int]int{}) {
+		t.Errorf("incorrect status of the stopped hub")
+	}
+}
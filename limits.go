@@ -0,0 +1,100 @@
+package go_remote
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SocketConfig configures timeouts and limits of websocket connections
+type SocketConfig struct {
+	// PongWait is a time to wait for the pong from the client, default is 60 seconds
+	PongWait time.Duration
+	// PingPeriod is a period of pings, must be less than PongWait, default is 90% of PongWait
+	PingPeriod time.Duration
+	// WriteWait is a time allowed to write a message, default is 10 seconds
+	WriteWait time.Duration
+	// MaxMessageSize is a max size of incoming message, default is MaxSocketMessageSize
+	MaxMessageSize int64
+
+	// MaxCalls is a max count of in-flight calls of a connection, each call of a batch is counted
+	MaxCalls int
+	// MaxSubscriptions is a max count of channels and patterns, subscribed by a connection
+	MaxSubscriptions int
+	// MaxUserConnections is a max count of connections of a single user, anonymous users are not limited
+	MaxUserConnections int
+
+	// Pool limits concurrent processing of messages of a connection
+	Pool PoolConfig
+}
+
+var socketConfigValue = key(6)
+
+// WithSocketConfig overrides the socket config of the server for a single connection,
+// it can be used in the Connect handler of the server
+func WithSocketConfig(ctx context.Context, config SocketConfig) context.Context {
+	return context.WithValue(ctx, socketConfigValue, config)
+}
+
+func normalizeSocketConfig(config SocketConfig) SocketConfig {
+	if config.PongWait <= 0 {
+		config.PongWait = pongWait
+	}
+	if config.PingPeriod <= 0 || config.PingPeriod >= config.PongWait {
+		config.PingPeriod = (config.PongWait * 9) / 10
+	}
+	if config.WriteWait <= 0 {
+		config.WriteWait = writeWait
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = int64(MaxSocketMessageSize)
+	}
+
+	return config
+}
+
+// subscriptionSet stores channels, subscribed by a connection
+type subscriptionSet struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func newSubscriptionSet() *subscriptionSet {
+	return &subscriptionSet{names: make(map[string]bool)}
+}
+
+// add stores the channel, it fails when there are max subscriptions already
+func (s *subscriptionSet) add(name string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if max > 0 && !s.names[name] && len(s.names) >= max {
+		return false
+	}
+
+	s.names[name] = true
+	return true
+}
+
+// remove deletes the channel, empty name removes all channels
+func (s *subscriptionSet) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		s.names = make(map[string]bool)
+	} else {
+		delete(s.names, name)
+	}
+}
+
+func (s *subscriptionSet) copy() *subscriptionSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := newSubscriptionSet()
+	for name := range s.names {
+		out.names[name] = true
+	}
+	return out
+}
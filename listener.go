@@ -0,0 +1,90 @@
+package go_remote
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const listenerQueueSize = 256
+
+// listener is an in-process subscriber of the hub
+type listener struct {
+	channel string
+	pattern bool
+	out     chan<- Message
+}
+
+// Subscription is a handle of the in-process subscriber
+type Subscription struct {
+	hub      *Hub
+	listener *listener
+	once     sync.Once
+	stop     func()
+}
+
+// SubscribeFunc calls the handler for each message of the channel, channel name can be a pattern
+//
+// Handler is called in its own goroutine, in the order of publishing, messages are dropped
+// when the handler can't process them fast enough. Channel guards and delivery limits of
+// the message ( users, connections ) are not applied to in-process subscribers
+func (h *Hub) SubscribeFunc(channel string, handler func(*Message)) *Subscription {
+	queue := make(chan Message, listenerQueueSize)
+	go func() {
+		for m := range queue {
+			handler(&m)
+		}
+	}()
+
+	s := h.listen(channel, queue)
+	s.stop = func() { close(queue) }
+	return s
+}
+
+// SubscribeChan sends each message of the channel to the Go channel, channel name can be a pattern,
+// messages are dropped when the Go channel is full, the Go channel is not closed by Unsubscribe
+func (h *Hub) SubscribeChan(channel string, out chan<- Message) *Subscription {
+	return h.listen(channel, out)
+}
+
+func (h *Hub) listen(channel string, out chan<- Message) *Subscription {
+	l := &listener{channel: channel, pattern: isPattern(channel), out: out}
+	h.do(func() {
+		h.listeners[l] = true
+	})
+
+	return &Subscription{hub: h, listener: l}
+}
+
+// Unsubscribe stops delivery of messages, it is safe to call it more than once
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.hub.do(func() {
+			delete(s.hub.listeners, s.listener)
+		})
+		if s.stop != nil {
+			s.stop()
+		}
+	})
+}
+
+func (l *listener) matches(name string) bool {
+	if l.pattern {
+		return matchPattern(l.channel, name)
+	}
+	return l.channel == name
+}
+
+// notifyListeners passes the message to in-process subscribers, it never blocks
+func (h *Hub) notifyListeners(m *Message) {
+	for l := range h.listeners {
+		if !l.matches(m.Channel) {
+			continue
+		}
+
+		select {
+		case l.out <- *m:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package go_remote
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeChan(t *testing.T) {
+	h := newHub()
+	go h.Run()
+	defer h.Stop()
+
+	out := make(chan Message, 10)
+	sub := h.SubscribeChan("orders.*", out)
+
+	h.Publish("orders.new", 1)
+	h.Publish("users.new", 2)
+	h.Publish("orders.old", 3)
+
+	for _, value := range []int{1, 3} {
+		select {
+		case m := <-out:
+			if m.Content != value {
+				t.Errorf("expected %d, got %v", value, m.Content)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d is not received", value)
+		}
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	h.Publish("orders.new", 4)
+	h.Status()
+
+	if len(out) != 0 {
+		t.Errorf("message is received after unsubscribe")
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	h := newHub()
+	go h.Run()
+	defer h.Stop()
+
+	received := make(chan string, 1)
+	sub := h.SubscribeFunc("orders", func(m *Message) {
+		received <- m.Channel
+	})
+	defer sub.Unsubscribe()
+
+	h.Publish("orders", nil)
+	select {
+	case name := <-received:
+		if name != "orders" {
+			t.Errorf("expected orders, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+}
@@ -0,0 +1,193 @@
+package go_remote
+
+import (
+	"errors"
+	"strings"
+)
+
+// patternNode is a node of the tree, which stores pattern subscriptions
+//
+// Pattern is a channel name, where "*" segment matches any single segment
+// and ">" as the last segment matches one or more segments, so "orders.*"
+// matches "orders.new", and "orders.>" matches "orders.new.eu"
+type patternNode struct {
+	children map[string]*patternNode
+	clients  map[*Client]bool
+}
+
+func newPatternNode() *patternNode {
+	return &patternNode{
+		children: make(map[string]*patternNode),
+		clients:  make(map[*Client]bool),
+	}
+}
+
+func isPattern(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if part == "*" || part == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChannelName checks that channel name or pattern has no empty segments
+// and wildcards are used only as whole segments
+func validateChannelName(name string) error {
+	if name == "" {
+		return errors.New("Channel name is empty")
+	}
+
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if part == "" {
+			return errors.New("Channel name has an empty segment")
+		}
+		if part == ">" && i != len(parts)-1 {
+			return errors.New("Channel name can have \">\" only as the last segment")
+		}
+		if part != "*" && part != ">" && strings.ContainsAny(part, "*>") {
+			return errors.New("Channel name can have wildcards only as whole segments")
+		}
+	}
+
+	return nil
+}
+
+// matchPattern checks whether the channel name matches the pattern
+func matchPattern(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "."), strings.Split(name, "."))
+}
+
+func matchParts(pattern, name []string) bool {
+	for i, part := range pattern {
+		if part == ">" {
+			return len(name) > i
+		}
+		if i >= len(name) || (part != "*" && part != name[i]) {
+			return false
+		}
+	}
+
+	return len(pattern) == len(name)
+}
+
+// overlapPattern checks whether there is a channel name, matched by both patterns
+func overlapPattern(a, b string) bool {
+	return overlapParts(strings.Split(a, "."), strings.Split(b, "."))
+}
+
+func overlapParts(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == ">" || b[i] == ">" {
+			return true
+		}
+		if a[i] != "*" && b[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+
+	return len(a) == len(b)
+}
+
+func (n *patternNode) add(pattern string, c *Client) {
+	node := n
+	for _, part := range strings.Split(pattern, ".") {
+		next, ok := node.children[part]
+		if !ok {
+			next = newPatternNode()
+			node.children[part] = next
+		}
+		node = next
+	}
+
+	node.clients[c] = true
+}
+
+func (n *patternNode) remove(pattern string, c *Client) {
+	n.removeParts(strings.Split(pattern, "."), c)
+}
+
+func (n *patternNode) removeParts(parts []string, c *Client) {
+	if len(parts) == 0 {
+		delete(n.clients, c)
+		return
+	}
+
+	next, ok := n.children[parts[0]]
+	if !ok {
+		return
+	}
+
+	next.removeParts(parts[1:], c)
+	if next.empty() {
+		delete(n.children, parts[0])
+	}
+}
+
+// removeClient removes all subscriptions of the client
+func (n *patternNode) removeClient(c *Client) {
+	delete(n.clients, c)
+	for part, next := range n.children {
+		next.removeClient(c)
+		if next.empty() {
+			delete(n.children, part)
+		}
+	}
+}
+
+// replace moves all subscriptions of the client to the other one
+func (n *patternNode) replace(old, c *Client) {
+	if n.clients[old] {
+		delete(n.clients, old)
+		n.clients[c] = true
+	}
+	for _, next := range n.children {
+		next.replace(old, c)
+	}
+}
+
+func (n *patternNode) empty() bool {
+	return len(n.clients) == 0 && len(n.children) == 0
+}
+
+// match calls the handler for each client, subscribed to a pattern which matches the name
+func (n *patternNode) match(name string, handler func(c *Client)) {
+	n.matchParts(strings.Split(name, "."), handler)
+}
+
+func (n *patternNode) matchParts(parts []string, handler func(c *Client)) {
+	if len(parts) == 0 {
+		for c := range n.clients {
+			handler(c)
+		}
+		return
+	}
+
+	if next, ok := n.children[parts[0]]; ok {
+		next.matchParts(parts[1:], handler)
+	}
+	if next, ok := n.children["*"]; ok {
+		next.matchParts(parts[1:], handler)
+	}
+	if next, ok := n.children[">"]; ok {
+		for c := range next.clients {
+			handler(c)
+		}
+	}
+}
+
+// patterns collects subscribers of all stored patterns
+func (n *patternNode) patterns(prefix string, out map[string][]*Client) {
+	for c := range n.clients {
+		out[prefix] = append(out[prefix], c)
+	}
+
+	for part, next := range n.children {
+		name := part
+		if prefix != "" {
+			name = prefix + "." + part
+		}
+		next.patterns(name, out)
+	}
+}
@@ -0,0 +1,66 @@
+package go_remote
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"orders.*", "orders.new", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.new.eu", false},
+		{"orders.>", "orders.new", true},
+		{"orders.>", "orders.new.eu", true},
+		{"orders.>", "orders", false},
+		{"*.new", "orders.new", true},
+		{"*.new", "orders.old", false},
+		{">", "orders", true},
+		{"orders", "orders", true},
+	}
+
+	for _, test := range tests {
+		if matchPattern(test.pattern, test.name) != test.match {
+			t.Errorf("matchPattern(%q, %q) must be %v", test.pattern, test.name, test.match)
+		}
+
+		node := newPatternNode()
+		client := &Client{}
+		node.add(test.pattern, client)
+
+		found := false
+		node.match(test.name, func(c *Client) { found = c == client })
+		if found != test.match {
+			t.Errorf("pattern tree %q, %q must be %v", test.pattern, test.name, test.match)
+		}
+
+		node.remove(test.pattern, client)
+		if !node.empty() {
+			t.Errorf("pattern tree %q is not empty after removing", test.pattern)
+		}
+	}
+}
+
+func TestOverlapPattern(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"admin.>", "admin.users", true},
+		{"admin.>", "admin.*", true},
+		{"admin.>", ">", true},
+		{"admin.>", "*.users", true},
+		{"admin.>", "admin", false},
+		{"admin.>", "orders.*", false},
+		{"admin.*", "admin.users.list", false},
+		{"admin", "admin", true},
+		{"admin", "*", true},
+	}
+
+	for _, test := range tests {
+		if overlapPattern(test.a, test.b) != test.overlap || overlapPattern(test.b, test.a) != test.overlap {
+			t.Errorf("overlapPattern(%q, %q) must be %v", test.a, test.b, test.overlap)
+		}
+	}
+}
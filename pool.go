@@ -0,0 +1,93 @@
+package go_remote
+
+import (
+	"errors"
+	"sync"
+)
+
+// PoolConfig limits concurrent processing of websocket messages, each call of a batch is counted separately
+type PoolConfig struct {
+	// Workers is a max count of messages and calls, processed at the same time, zero means no limit
+	Workers int
+	// Queue is a max count of messages and calls, which wait for a free worker,
+	// others are rejected with "Server is busy" error
+	Queue int
+}
+
+var callPoolValue = key(9)
+
+var errBusy = errors.New("Server is busy")
+
+// callPool limits calls of a batch, each call reserves its own place,
+// the rejected call receives the error of reserve as the response
+type callPool interface {
+	reserve() error
+	acquire()
+	release()
+}
+
+// workerPool is a semaphore with a bounded queue, nil pool has no limits
+type workerPool struct {
+	mu       sync.Mutex
+	reserved int
+	capacity int
+	slots    chan struct{}
+}
+
+func newWorkerPool(config PoolConfig) *workerPool {
+	if config.Workers <= 0 {
+		return nil
+	}
+	if config.Queue < 0 {
+		config.Queue = 0
+	}
+
+	return &workerPool{
+		capacity: config.Workers + config.Queue,
+		slots:    make(chan struct{}, config.Workers),
+	}
+}
+
+// reserve takes a place in the pool, it fails when workers and queue are full
+func (p *workerPool) reserve() bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reserved >= p.capacity {
+		return false
+	}
+	p.reserved += 1
+	return true
+}
+
+// acquire waits for a free worker
+func (p *workerPool) acquire() {
+	if p != nil {
+		p.slots <- struct{}{}
+	}
+}
+
+// release frees the worker and the reserved place
+func (p *workerPool) release() {
+	if p == nil {
+		return
+	}
+
+	<-p.slots
+	p.cancel()
+}
+
+// cancel frees the reserved place, which has no worker
+func (p *workerPool) cancel() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.reserved -= 1
+	p.mu.Unlock()
+}
@@ -0,0 +1,67 @@
+package go_remote
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(PoolConfig{Workers: 1, Queue: 1})
+
+	if !p.reserve() || !p.reserve() {
+		t.Fatal("pool must accept a worker and a queued message")
+	}
+	if p.reserve() {
+		t.Fatal("pool must reject a message, when workers and queue are full")
+	}
+
+	p.acquire()
+	p.release()
+	if !p.reserve() {
+		t.Fatal("pool must accept a message after release")
+	}
+
+	p.cancel()
+	p.cancel()
+	if !p.reserve() {
+		t.Fatal("pool must accept a message after cancel")
+	}
+
+	var unlimited *workerPool
+	if !unlimited.reserve() {
+		t.Fatal("nil pool must not have limits")
+	}
+	unlimited.acquire()
+	unlimited.release()
+}
+
+func TestSocketBatchPool(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true, Socket: SocketConfig{Pool: PoolConfig{Workers: 1, Queue: 1}}})
+	service := &SlowService{started: make(chan bool, 2), release: make(chan bool)}
+	s.AddService("slow", service)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"call","id":"m1","each":true,"body":[
+		{"id":"1","name":"slow.Slow","args":[]},
+		{"id":"2","name":"slow.Slow","args":[]},
+		{"id":"3","name":"slow.Slow","args":[]}]}`))
+
+	m := readSocket(t, conn)
+	if res, _ := m.Body.(map[string]interface{}); m.Action != "response" || res["id"] != "3" || res["error"] != "Server is busy" {
+		t.Fatalf("call over the pool limit was not rejected, %+v", m)
+	}
+
+	close(service.release)
+	for i := 0; i < 2; i++ {
+		m := readSocket(t, conn)
+		if res, _ := m.Body.(map[string]interface{}); m.Action != "response" || res["data"] != "slow" {
+			t.Errorf("call in the pool limit was not processed, %+v", m)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package go_remote
+
+import "sort"
+
+// PresenceEvent is sent to subscribers of a presence channel
+//
+// Status is "join" or "leave" when the first connection of a user subscribes
+// or the last one drops, "update" when metadata of a connection is changed,
+// and "members" with the list of current members for a new subscriber
+type PresenceEvent struct {
+	Channel    string           `json:"name"`
+	Status     string           `json:"status"`
+	User       int              `json:"user,omitempty"`
+	Connection ConnectionID     `json:"connection,omitempty"`
+	Meta       interface{}      `json:"meta,omitempty"`
+	Members    []PresenceMember `json:"members,omitempty"`
+}
+
+// PresenceMember describes a user, subscribed to the presence channel
+type PresenceMember struct {
+	User        int                  `json:"user"`
+	Connections []PresenceConnection `json:"connections"`
+}
+
+// PresenceConnection describes a single connection of the presence member
+type PresenceConnection struct {
+	ID   ConnectionID `json:"id"`
+	Meta interface{}  `json:"meta,omitempty"`
+}
+
+type presenceChannel struct {
+	users map[int]map[*Client]bool
+}
+
+// AddPresence enables tracking of the users, subscribed to the channel, it can be called at any time,
+// current subscribers of the channel become members without join events
+func (h *Hub) AddPresence(name string) {
+	h.do(func() {
+		if _, ok := h.presence[name]; ok {
+			return
+		}
+
+		ch := &presenceChannel{users: make(map[int]map[*Client]bool)}
+		for c := range h.channels[name].clients {
+			if ch.users[c.User] == nil {
+				ch.users[c.User] = make(map[*Client]bool)
+			}
+			ch.users[c.User][c] = true
+		}
+		h.presence[name] = ch
+	})
+}
+
+// SetPresenceMeta sets metadata of the connection, which is shown in all its presence channels
+func (h *Hub) SetPresenceMeta(c *Client, meta interface{}) {
+	h.do(func() {
+		h.meta[c] = meta
+		for name, ch := range h.presence {
+			if ch.users[c.User][c] {
+				h.sendPresence(name, &PresenceEvent{Status: "update", User: c.User, Connection: ConnectionID(c.ConnID), Meta: meta})
+			}
+		}
+	})
+}
+
+// Members returns users, subscribed to the presence channel
+func (h *Hub) Members(name string) []PresenceMember {
+	var out []PresenceMember
+	h.do(func() {
+		out = h.members(name)
+	})
+
+	return out
+}
+
+func (h *Hub) members(name string) []PresenceMember {
+	ch, ok := h.presence[name]
+	if !ok {
+		return nil
+	}
+
+	out := make([]PresenceMember, 0, len(ch.users))
+	for user, clients := range ch.users {
+		member := PresenceMember{User: user, Connections: make([]PresenceConnection, 0, len(clients))}
+		for c := range clients {
+			member.Connections = append(member.Connections, PresenceConnection{ID: ConnectionID(c.ConnID), Meta: h.meta[c]})
+		}
+		sort.Slice(member.Connections, func(i, j int) bool { return member.Connections[i].ID < member.Connections[j].ID })
+		out = append(out, member)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+
+	return out
+}
+
+// joinPresence registers the subscriber in the presence channel
+func (h *Hub) joinPresence(name string, c *Client) {
+	ch, ok := h.presence[name]
+	if !ok {
+		return
+	}
+
+	clients, ok := ch.users[c.User]
+	if !ok {
+		clients = make(map[*Client]bool)
+		ch.users[c.User] = clients
+	}
+	if clients[c] {
+		return
+	}
+	clients[c] = true
+
+	if len(clients) == 1 {
+		h.sendPresence(name, &PresenceEvent{Status: "join", User: c.User, Connection: ConnectionID(c.ConnID), Meta: h.meta[c]})
+	}
+	c.SendMessage("presence", &PresenceEvent{Channel: name, Status: "members", Members: h.members(name)})
+}
+
+// leavePresence removes the subscriber from the presence channel
+func (h *Hub) leavePresence(name string, c *Client) {
+	ch, ok := h.presence[name]
+	if !ok {
+		return
+	}
+
+	clients := ch.users[c.User]
+	if !clients[c] {
+		return
+	}
+
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(ch.users, c.User)
+		h.sendPresence(name, &PresenceEvent{Status: "leave", User: c.User, Connection: ConnectionID(c.ConnID)})
+	}
+}
+
+func (h *Hub) sendPresence(name string, e *PresenceEvent) {
+	e.Channel = name
+	for c := range h.recipients(name) {
+		c.SendMessage("presence", e)
+	}
+}
@@ -0,0 +1,97 @@
+package go_remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func newTestClient(s *Server, user, conn int) *Client {
+	return &Client{
+		Server: s,
+		User:   user,
+		ConnID: conn,
+		queue:  newSendQueue(QueueConfig{}, &s.Events.dropped),
+		done:   make(chan struct{}),
+	}
+}
+
+// presenceEvents returns queued presence events of the client as "status user" strings
+func presenceEvents(c *Client) []string {
+	out := make([]string, 0)
+	for _, data := range c.queue.take() {
+		m := struct {
+			Action string
+			Body   PresenceEvent
+		}{}
+		json.Unmarshal(data, &m)
+		if m.Action == "presence" {
+			out = append(out, fmt.Sprintf("%s %d", m.Body.Status, m.Body.User))
+		}
+	}
+	return out
+}
+
+func TestPresenceJoinLeave(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	defer s.Events.Stop()
+	s.Events.AddPresence("room")
+
+	observer := newTestClient(s, 2, 20)
+	first := newTestClient(s, 1, 10)
+	second := newTestClient(s, 1, 11)
+	s.Events.Subscribe("room", observer)
+	presenceEvents(observer)
+
+	tests := []struct {
+		name     string
+		change   func()
+		expected []string
+	}{
+		{"first connection joins", func() { s.Events.Subscribe("room", first) }, []string{"join 1"}},
+		{"second connection joins", func() { s.Events.Subscribe("room", second) }, []string{}},
+		{"first connection leaves", func() { s.Events.UnSubscribe("room", first) }, []string{}},
+		{"last connection leaves", func() { s.Events.UnSubscribe("room", second) }, []string{"leave 1"}},
+	}
+
+	for _, test := range tests {
+		test.change()
+		if events := presenceEvents(observer); !reflect.DeepEqual(events, test.expected) {
+			t.Errorf("%s: incorrect events %v", test.name, events)
+		}
+	}
+
+	for _, c := range []*Client{first, second} {
+		for _, e := range presenceEvents(c) {
+			if e == "leave 1" {
+				t.Errorf("connection %d received its own leave event", c.ConnID)
+			}
+		}
+	}
+}
+
+func TestPresenceMembers(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	defer s.Events.Stop()
+
+	first := newTestClient(s, 1, 10)
+	second := newTestClient(s, 1, 11)
+	other := newTestClient(s, 2, 20)
+	s.Events.Subscribe("room", first)
+	s.Events.AddPresence("room")
+	s.Events.Subscribe("room", second)
+	s.Events.Subscribe("room", other)
+	s.Events.SetPresenceMeta(other, "mobile")
+
+	expected := []PresenceMember{
+		{User: 1, Connections: []PresenceConnection{{ID: 10}, {ID: 11}}},
+		{User: 2, Connections: []PresenceConnection{{ID: 20, Meta: "mobile"}}},
+	}
+	if members := s.Events.Members("room"); !reflect.DeepEqual(members, expected) {
+		t.Errorf("incorrect members %+v", members)
+	}
+	if members := s.Events.Members("unknown"); members != nil {
+		t.Errorf("channel without presence has members %+v", members)
+	}
+}
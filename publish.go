@@ -0,0 +1,101 @@
+package go_remote
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// PublishGuard allows or denies publishing of the client to the channel
+type PublishGuard func(channel string, c *Client) bool
+
+// PublishHandler can validate or change the message, published by the client,
+// returned error rejects the message and is sent to the client
+type PublishHandler func(m *Message, c *Client) error
+
+// MessageSender describes the client, which published the message
+type MessageSender struct {
+	User       int          `json:"user"`
+	Connection ConnectionID `json:"connection"`
+}
+
+type publishHandler struct {
+	name    string
+	handler PublishHandler
+}
+
+// AddPublishGuard allows clients to publish to the channel, name can be a pattern,
+// clients can publish only to channels with a guard and all matching guards must pass,
+// guards must be added before the server starts to accept connections
+func (h *Hub) AddPublishGuard(name string, guard PublishGuard) {
+	h.publishGuards[name] = guard
+}
+
+// AddPublishHandler adds a handler for messages, which clients publish to the channel,
+// name can be a pattern, handlers are called in the order of adding,
+// handlers must be added before the server starts to accept connections
+func (h *Hub) AddPublishHandler(name string, handler PublishHandler) {
+	h.publishHandlers = append(h.publishHandlers, publishHandler{name: name, handler: handler})
+}
+
+// CanPublish checks publish guards of the channel
+func (h *Hub) CanPublish(channel string, c *Client) bool {
+	allowed := false
+	for name, guard := range h.publishGuards {
+		if matchPattern(name, channel) {
+			if !guard(channel, c) {
+				return false
+			}
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// publishFrom checks and publishes the message of the client
+func (h *Hub) publishFrom(m *Message, c *Client) error {
+	if !h.CanPublish(m.Channel, c) {
+		return errors.New("Access Denied")
+	}
+
+	for _, p := range h.publishHandlers {
+		if matchPattern(p.name, m.Channel) {
+			if err := p.handler(m, c); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.send(*m)
+	return nil
+}
+
+func (c *Client) publish(m *RequestMessage) error {
+	if err := validateChannelName(m.Name); err != nil {
+		return err
+	}
+	if isPattern(m.Name) {
+		return errors.New("Can't publish to a pattern")
+	}
+
+	body := struct {
+		Value        json.RawMessage `json:"value"`
+		ExceptSender bool            `json:"exceptSender"`
+	}{}
+	if len(m.Body) != 0 {
+		if err := json.Unmarshal(m.Body, &body); err != nil {
+			return errors.New("Invalid message")
+		}
+	}
+
+	msg := Message{
+		Channel: m.Name,
+		Content: body.Value,
+		Sender:  &MessageSender{User: c.User, Connection: ConnectionID(c.ConnID)},
+	}
+	if body.ExceptSender {
+		msg.Except = ConnectionID(c.ConnID)
+	}
+
+	return c.Server.Events.publishFrom(&msg, c)
+}
@@ -0,0 +1,105 @@
+package go_remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// channelEvents returns events of the client as "channel value sender" strings,
+// it waits till the event of the last channel
+func channelEvents(t *testing.T, c *Client, last string) []string {
+	out := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		for _, data := range c.queue.take() {
+			m := struct {
+				Action string
+				Body   Message
+			}{}
+			json.Unmarshal(data, &m)
+			if m.Action != "event" {
+				continue
+			}
+			if m.Body.Channel == last {
+				return out
+			}
+
+			sender := "server"
+			if m.Body.Sender != nil {
+				sender = fmt.Sprintf("%d/%d", m.Body.Sender.User, m.Body.Sender.Connection)
+			}
+			out = append(out, fmt.Sprintf("%s %v %s", m.Body.Channel, m.Body.Content, sender))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("connection %d didn't receive event of %s", c.ConnID, last)
+	return nil
+}
+
+func TestClientPublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		guard    PublishGuard
+		handler  PublishHandler
+		body     string
+		error    string
+		sender   []string
+		receiver []string
+	}{
+		{"without guard", nil, nil, `{"value":1}`, "Access Denied", []string{}, []string{}},
+		{"denied by guard", func(ch string, c *Client) bool { return c.User != 1 }, nil, `{"value":1}`, "Access Denied", []string{}, []string{}},
+		{"rejected by handler", nil, func(m *Message, c *Client) error { return errors.New("Invalid value") }, `{"value":1}`, "Invalid value", []string{}, []string{}},
+		{"changed by handler", nil, func(m *Message, c *Client) error { m.Content = 2; return nil }, `{"value":1}`, "", []string{"chat.room 2 1/10"}, []string{"chat.room 2 1/10"}},
+		{"allowed", nil, nil, `{"value":1}`, "", []string{"chat.room 1 1/10"}, []string{"chat.room 1 1/10"}},
+		{"except sender", nil, nil, `{"value":1,"exceptSender":true}`, "", []string{}, []string{"chat.room 1 1/10"}},
+	}
+
+	for _, test := range tests {
+		s := NewServer(&ServerConfig{WebSocket: true})
+		if test.name != "without guard" {
+			guard := test.guard
+			if guard == nil {
+				guard = func(ch string, c *Client) bool { return true }
+			}
+			s.Events.AddPublishGuard("chat.room", guard)
+		}
+		if test.handler != nil {
+			s.Events.AddPublishHandler("chat.*", test.handler)
+		}
+
+		sender := newTestClient(s, 1, 10)
+		receiver := newTestClient(s, 2, 20)
+		for _, c := range []*Client{sender, receiver} {
+			s.Events.Subscribe("chat.room", c)
+			s.Events.Subscribe("end", c)
+		}
+
+		err := sender.publish(&RequestMessage{Action: "publish", Name: "chat.room", Body: json.RawMessage(test.body)})
+		if (err == nil && test.error != "") || (err != nil && err.Error() != test.error) {
+			t.Errorf("%s: incorrect error %v", test.name, err)
+		}
+
+		s.Events.Publish("end", nil)
+		if out := channelEvents(t, sender, "end"); fmt.Sprint(out) != fmt.Sprint(test.sender) {
+			t.Errorf("%s: incorrect events of the sender %v", test.name, out)
+		}
+		if out := channelEvents(t, receiver, "end"); fmt.Sprint(out) != fmt.Sprint(test.receiver) {
+			t.Errorf("%s: incorrect events of the receiver %v", test.name, out)
+		}
+		s.Events.Stop()
+	}
+}
+
+func TestClientPublishToPattern(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	defer s.Events.Stop()
+	s.Events.AddPublishGuard("*", func(ch string, c *Client) bool { return true })
+
+	c := newTestClient(s, 1, 10)
+	if err := c.publish(&RequestMessage{Action: "publish", Name: "room.*"}); err == nil {
+		t.Errorf("publishing to a pattern must be rejected")
+	}
+}
@@ -0,0 +1,201 @@
+package go_remote
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// SendPolicy defines how the client reacts on overflow of its send queue
+//
+// Policies are applied only to messages, initiated by the server ( events, presence
+// and data updates ), responses to the client requests are always queued
+type SendPolicy int
+
+const (
+	// DropNewest ignores new messages, while the queue is full
+	DropNewest SendPolicy = iota
+	// DropOldest removes the oldest queued message to free space for the new one
+	DropOldest
+	// CoalesceChannel replaces the queued message of the same channel with the new one,
+	// if there is no such message the oldest one is removed
+	CoalesceChannel
+	// DisconnectSlow closes the connection, when the queue is overflowed Limit times in a row
+	DisconnectSlow
+)
+
+// QueueConfig configures the send queue of a websocket client
+type QueueConfig struct {
+	// Size is a max count of queued messages, default is 256
+	Size int
+	// Policy is applied when the queue is full
+	Policy SendPolicy
+	// Limit is count of overflows in a row, which closes the connection for DisconnectSlow policy
+	Limit int
+}
+
+const defaultQueueSize = 256
+
+var queueConfigValue = key(5)
+
+// WithQueueConfig overrides the queue config of the server for a single connection,
+// it can be used in the Connect handler of the server
+func WithQueueConfig(ctx context.Context, config QueueConfig) context.Context {
+	return context.WithValue(ctx, queueConfigValue, config)
+}
+
+type queuedMessage struct {
+	data      []byte
+	key       string
+	droppable bool
+}
+
+type sendQueue struct {
+	mu       sync.Mutex
+	config   QueueConfig
+	messages []queuedMessage
+	notify   chan struct{}
+	// space is closed when the writer takes queued messages, it is created only for waiting senders
+	space chan struct{}
+
+	dropped  uint64
+	total    *uint64
+	overflow int
+}
+
+// newSendQueue creates a queue, dropped messages are counted in the queue and in the total counter
+func newSendQueue(config QueueConfig, total *uint64) *sendQueue {
+	if config.Size <= 0 {
+		config.Size = defaultQueueSize
+	}
+	if config.Limit <= 0 {
+		config.Limit = 1
+	}
+
+	return &sendQueue{config: config, total: total, notify: make(chan struct{}, 1)}
+}
+
+// push adds message to the queue, it never blocks
+// and returns false when the client must be disconnected
+func (q *sendQueue) push(m queuedMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !m.droppable || len(q.messages) < q.config.Size {
+		q.overflow = 0
+		q.add(m)
+		return true
+	}
+
+	q.overflow += 1
+	switch q.config.Policy {
+	case DropOldest:
+		q.dropOldest()
+		q.add(m)
+	case CoalesceChannel:
+		if !q.replace(m) {
+			q.dropOldest()
+			q.add(m)
+		}
+	case DisconnectSlow:
+		q.drop()
+		return q.overflow < q.config.Limit
+	default:
+		q.drop()
+	}
+
+	return true
+}
+
+func (q *sendQueue) drop() {
+	q.dropped += 1
+	atomic.AddUint64(q.total, 1)
+}
+
+func (q *sendQueue) add(m queuedMessage) {
+	q.messages = append(q.messages, m)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// replace updates the queued message with the same key
+func (q *sendQueue) replace(m queuedMessage) bool {
+	if m.key == "" {
+		return false
+	}
+
+	// the last message is replaced, to keep order of messages in the channel
+	for i := len(q.messages) - 1; i >= 0; i-- {
+		if q.messages[i].key == m.key {
+			q.messages[i] = m
+			q.drop()
+			return true
+		}
+	}
+	return false
+}
+
+func (q *sendQueue) dropOldest() {
+	for i := range q.messages {
+		if q.messages[i].droppable {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.drop()
+			return
+		}
+	}
+	// there is nothing to drop, so the queue grows
+}
+
+// wait blocks while the queue is full, so senders of messages which can't be dropped
+// don't grow the queue faster than the client receives them
+func (q *sendQueue) wait(ctx context.Context, done <-chan struct{}) error {
+	for {
+		q.mu.Lock()
+		if len(q.messages) < q.config.Size {
+			q.mu.Unlock()
+			return nil
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return errors.New("Client is disconnected")
+		}
+	}
+}
+
+// take returns all queued messages
+func (q *sendQueue) take() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+
+	out := make([][]byte, len(q.messages))
+	for i := range q.messages {
+		out[i] = q.messages[i].data
+	}
+	q.messages = q.messages[:0]
+
+	return out
+}
+
+func (q *sendQueue) status() (int, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages), q.dropped
+}
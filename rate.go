@@ -0,0 +1,37 @@
+package go_remote
+
+import "time"
+
+const rateWindow = 60
+
+// rateCounter counts events per second during the last minute
+type rateCounter struct {
+	total   uint64
+	buckets [rateWindow]uint64
+	seconds [rateWindow]int64
+}
+
+func (r *rateCounter) add(now time.Time, n uint64) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	if r.seconds[i] != sec {
+		r.seconds[i] = sec
+		r.buckets[i] = 0
+	}
+
+	r.buckets[i] += n
+	r.total += n
+}
+
+// perSecond returns average count of events per second during the last minute
+func (r *rateCounter) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+	var sum uint64
+	for i := range r.buckets {
+		if sec-r.seconds[i] < rateWindow {
+			sum += r.buckets[i]
+		}
+	}
+
+	return float64(sum) / rateWindow
+}
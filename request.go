@@ -0,0 +1,145 @@
+package go_remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientCallTimeout limits calls of client handlers, which context has no deadline
+var ClientCallTimeout = 10 * time.Second
+
+type clientReply struct {
+	body json.RawMessage
+	err  string
+}
+
+// clientCalls stores calls of client handlers, which wait for the reply
+type clientCalls struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[string]chan clientReply
+}
+
+func newClientCalls() *clientCalls {
+	return &clientCalls{waiting: make(map[string]chan clientReply)}
+}
+
+func (r *clientCalls) add() (string, chan clientReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next += 1
+	id := strconv.FormatUint(r.next, 10)
+	wait := make(chan clientReply, 1)
+	r.waiting[id] = wait
+
+	return id, wait
+}
+
+func (r *clientCalls) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.waiting, id)
+}
+
+func (r *clientCalls) resolve(id string, reply clientReply) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wait, ok := r.waiting[id]
+	if !ok {
+		return false
+	}
+
+	delete(r.waiting, id)
+	wait <- reply
+	return true
+}
+
+// Call invokes the handler, registered on the client side, and waits for its reply
+//
+// Client receives { "action":"request", "id":"1", "name":"confirm", "body":args } and answers
+// with { "action":"reply", "id":"1", "body":result } or { "action":"reply", "id":"1", "error":"text" },
+// result is decoded into the reply object, ClientCallTimeout is used when ctx has no deadline
+func (c *Client) Call(ctx context.Context, name string, args interface{}, reply interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ClientCallTimeout)
+		defer cancel()
+	}
+
+	id, wait := c.calls.add()
+	defer c.calls.remove(id)
+
+	c.send(&ResponseMessage{Action: "request", ID: id, Name: name, Body: args})
+
+	select {
+	case r := <-wait:
+		if r.err != "" {
+			return errors.New(r.err)
+		}
+		if reply == nil || len(r.body) == 0 {
+			return nil
+		}
+		return json.Unmarshal(r.body, reply)
+	case <-c.done:
+		return errors.New("Client is disconnected")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CallUser invokes the client handler on all connections of the user
+// and returns the first successful reply
+func (s *Server) CallUser(ctx context.Context, user int, name string, args interface{}, reply interface{}) error {
+	clients := s.Events.findClients(func(c *Client) bool { return c.User == user })
+	if len(clients) == 0 {
+		return errors.New("User is not connected")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		body json.RawMessage
+		err  error
+	}
+	results := make(chan result, len(clients))
+	for _, c := range clients {
+		go func(c *Client) {
+			var body json.RawMessage
+			err := c.Call(ctx, name, args, &body)
+			results <- result{body, err}
+		}(c)
+	}
+
+	var err error
+	for range clients {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+
+		if reply == nil || len(r.body) == 0 {
+			return nil
+		}
+		return json.Unmarshal(r.body, reply)
+	}
+
+	return err
+}
+
+// reply passes the result of the client handler to the waiting call
+func (c *Client) reply(m *RequestMessage) error {
+	if !c.calls.resolve(m.ID, clientReply{body: m.Body, err: m.Error}) {
+		return errors.New("Unknown request")
+	}
+
+	return nil
+}
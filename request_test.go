@@ -0,0 +1,102 @@
+package go_remote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// answerRequest reads the request of the server and sends the reply
+func answerRequest(t *testing.T, conn *websocket.Conn, reply string) {
+	m := readSocket(t, conn)
+	if m.Action != "request" || m.Name != "confirm" {
+		t.Errorf("incorrect request %+v", m)
+		return
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"reply","id":"`+m.ID+`",`+reply+`}`))
+}
+
+func TestClientCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(t *testing.T, conn *websocket.Conn)
+		result string
+		error  error
+	}{
+		{"reply", func(t *testing.T, conn *websocket.Conn) {
+			answerRequest(t, conn, `"body":"yes"`)
+		}, "yes", nil},
+		{"error reply", func(t *testing.T, conn *websocket.Conn) {
+			answerRequest(t, conn, `"error":"denied"`)
+		}, "", errors.New("denied")},
+		{"timeout", func(t *testing.T, conn *websocket.Conn) {
+			readSocket(t, conn)
+		}, "", context.DeadlineExceeded},
+		{"disconnect", func(t *testing.T, conn *websocket.Conn) {
+			readSocket(t, conn)
+			conn.Close()
+		}, "", errors.New("Client is disconnected")},
+	}
+
+	s := NewServer(&ServerConfig{WebSocket: true})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, test := range tests {
+		conn := dialSocket(t, ts, "")
+		start := readSocket(t, conn)
+		clients := s.Events.findClients(func(c *Client) bool { return float64(c.ConnID) == start.Body })
+		if len(clients) != 1 {
+			t.Fatalf("%s: client is not registered", test.name)
+		}
+
+		go test.answer(t, conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		result := ""
+		err := clients[0].Call(ctx, "confirm", []int{1}, &result)
+		cancel()
+
+		if result != test.result || (err == nil) != (test.error == nil) || (err != nil && err.Error() != test.error.Error()) {
+			t.Errorf("%s: incorrect result %q, %v", test.name, result, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerCallUser(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	s.Connect = func(r *http.Request) (context.Context, error) {
+		return context.WithValue(r.Context(), UserValue, 1), nil
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if err := s.CallUser(context.Background(), 1, "confirm", nil, nil); err == nil || err.Error() != "User is not connected" {
+		t.Errorf("call of the disconnected user must fail, %v", err)
+	}
+
+	failed := dialSocket(t, ts, "")
+	defer failed.Close()
+	readSocket(t, failed)
+	replied := dialSocket(t, ts, "")
+	defer replied.Close()
+	readSocket(t, replied)
+
+	go answerRequest(t, failed, `"error":"denied"`)
+	go func() {
+		// the successful reply comes after the error
+		time.Sleep(20 * time.Millisecond)
+		answerRequest(t, replied, `"body":"yes"`)
+	}()
+
+	result := ""
+	if err := s.CallUser(context.Background(), 1, "confirm", nil, &result); err != nil || result != "yes" {
+		t.Errorf("first successful reply was not returned, %q, %v", result, err)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"errors"
 	"net/http"
 	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
 )
 
 // Guard is a guard function that allows or denies code execution based on the context
@@ -23,11 +26,31 @@ type Server struct {
 	Connect      Connect
 	Events       *Hub
 	Dependencies *dependencyStore
+
+	sessions *sessionStore
+	upgrader *websocket.Upgrader
+	pool     *workerPool
+
+	mu          sync.RWMutex
+	closing     bool
+	calls       sync.WaitGroup
+	connections sync.WaitGroup
 }
 
 type ServerConfig struct {
 	WebSocket  bool
 	WithoutKey bool
+
+	// Upgrader configures opening of websocket connections
+	Upgrader UpgraderConfig
+	// Socket configures timeouts and limits of websocket connections
+	Socket SocketConfig
+	// Pool limits concurrent processing of messages of all websocket connections
+	Pool PoolConfig
+	// Queue configures send queues of websocket clients
+	Queue QueueConfig
+	// Session configures resumable sessions and reliable delivery of events
+	Session SessionConfig
 }
 
 // Response handles results of remote calls
@@ -51,10 +74,13 @@ func NewServer(config *ServerConfig) *Server {
 	s.Events = newHub()
 
 	if s.config.WebSocket {
-		go s.Events.Run()
+		s.Events.start()
 	}
 
 	s.Dependencies = newDependencyStore()
+	s.sessions = newSessionStore(s.config.Session)
+	s.upgrader = newUpgrader(s.config.Upgrader)
+	s.pool = newWorkerPool(s.config.Pool)
 	s.Connect = func(r *http.Request) (context.Context, error) { return r.Context(), nil }
 	return &s
 }
@@ -71,15 +97,25 @@ func (s *Server) AddServiceWithGuard(name string, rcvr interface{}, guard Guard)
 
 // AddVariable adds a variable data to the API
 func (s *Server) AddVariable(name string, rcvr interface{}) error {
-	return s.registerData(name, rcvr, false)
+	return s.registerData(name, rcvr, false, nil)
+}
+
+// AddVariableWithGuard adds a variable data to the API, which is provided only when guard allows it
+func (s *Server) AddVariableWithGuard(name string, rcvr interface{}, guard Guard) error {
+	return s.registerData(name, rcvr, false, guard)
 }
 
 // AddConstant adds a constant data to the API
 func (s *Server) AddConstant(name string, rcvr interface{}) error {
-	return s.registerData(name, rcvr, true)
+	return s.registerData(name, rcvr, true, nil)
 }
 
-func (s *Server) registerData(name string, rcvr interface{}, isConstant bool) error {
+// AddConstantWithGuard adds a constant data to the API, which is provided only when guard allows it
+func (s *Server) AddConstantWithGuard(name string, rcvr interface{}, guard Guard) error {
+	return s.registerData(name, rcvr, true, guard)
+}
+
+func (s *Server) registerData(name string, rcvr interface{}, isConstant bool, guard Guard) error {
 	if _, ok := s.data[name]; ok {
 		return errors.New("service name already used")
 	}
@@ -88,9 +124,9 @@ func (s *Server) registerData(name string, rcvr interface{}, isConstant bool) er
 		if reflect.TypeOf(rcvr).Kind() == reflect.Ptr {
 			rcvr = reflect.ValueOf(rcvr).Elem().Interface()
 		}
-		s.data[name] = dataRecord{isConstant: true, value: rcvr}
+		s.data[name] = dataRecord{isConstant: true, value: rcvr, guard: guard}
 	} else {
-		s.data[name] = dataRecord{isConstant: false, rtype: reflect.TypeOf(rcvr)}
+		s.data[name] = dataRecord{isConstant: false, rtype: reflect.TypeOf(rcvr), guard: guard}
 	}
 
 	return nil
@@ -106,37 +142,140 @@ func (s *Server) register(name string, rcvr interface{}, guard Guard) error {
 	return nil
 }
 
+// Shutdown stops accepting new calls and connections, waits for in-flight calls,
+// closes all websocket connections and stops the hub
+//
+// When context is done before all calls are finished, connections are closed anyway
+// and the context error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	err := waitGroup(ctx, &s.calls)
+
+	if s.config.WebSocket {
+		for _, c := range s.Events.findClients(func(c *Client) bool { return true }) {
+			c.Close(websocket.CloseGoingAway, "server is shutting down")
+		}
+
+		// disconnect handlers are called by the hub, so it is stopped after all clients
+		if e := waitGroup(ctx, &s.connections); e != nil {
+			err = e
+		}
+	}
+
+	s.sessions.close()
+	s.Events.Stop()
+	s.Dependencies.singleton.close()
+
+	return err
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closing
+}
+
+// track registers an in-flight operation, it fails when server is shutting down
+func (s *Server) track(wg *sync.WaitGroup) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closing {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Process starts the package processing, executing all requested methods
 func (s *Server) Process(input []byte, c context.Context) []Response {
+	response := make([]Response, 0)
+	s.ProcessEach(input, c, func(r *Response) {
+		response = append(response, *r)
+	})
+
+	return response
+}
+
+// ProcessEach executes calls like Process, but passes each response to the handler as soon as
+// the call is finished, handler is called from the goroutine of ProcessEach
+func (s *Server) ProcessEach(input []byte, c context.Context, handler func(*Response)) {
 	data := callData{}
 	err := json.Unmarshal(input, &data)
-	response := make([]Response, len(data))
-
 	if err != nil {
 		log.Errorf(err.Error())
-		return response
+		return
+	}
+
+	if !s.track(&s.calls) {
+		for i := range data {
+			handler(&Response{ID: data[i].ID, Error: "Server is shutting down"})
+		}
+		return
 	}
+	defer s.calls.Done()
 
 	res := make(chan *Response)
+	c = withDependencyScope(c, BatchScope)
+	defer closeDependencyScope(c, BatchScope)
+
+	// calls of websocket messages are limited by the worker pools
+	pool, _ := c.Value(callPoolValue).(callPool)
 
+	started := 0
 	for i := range data {
 		data[i].parse()
+		if pool != nil {
+			if err := pool.reserve(); err != nil {
+				handler(&Response{ID: data[i].ID, Error: err.Error()})
+				continue
+			}
+		}
+
 		data[i].dependencies = s.Dependencies
-		data[i].ctx = c
+		data[i].ctx = withDependencyScope(c, CallScope)
+		started += 1
 
-		go s.Call(data[i], res)
+		go func(call *callInfo) {
+			if pool != nil {
+				pool.acquire()
+				defer pool.release()
+			}
+			s.Call(call, res)
+		}(data[i])
 	}
 
-	for i := range data {
-		response[i] = *(<-res)
+	for i := 0; i < started; i++ {
+		handler(<-res)
 	}
-
-	return response
 }
 
 // Call allows to execute some Servers's method
 func (s *Server) Call(call *callInfo, res chan *Response) {
 	response := Response{ID: call.ID}
+	defer func() {
+		closeDependencyScope(call.ctx, CallScope)
+		res <- &response
+	}()
 
 	log.Debugf("Call %s.%s", call.service, call.method)
 	service, ok := s.services[call.service]
@@ -145,6 +284,4 @@ func (s *Server) Call(call *callInfo, res chan *Response) {
 	} else {
 		service.Call(call, &response)
 	}
-
-	res <- &response
 }
@@ -52,6 +52,14 @@ func valueByType(atype reflect.Type, i int, thecall *callInfo) (reflect.Value, e
 }
 
 func (s *service) Call(thecall *callInfo, res *Response) {
+	var stream *Stream
+	var finish func(*Response)
+	// stream is finished after recovering, so it receives the error of the call
+	defer func() {
+		if finish != nil {
+			finish(res)
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorf(string(debug.Stack()))
@@ -73,6 +81,10 @@ func (s *service) Call(thecall *callInfo, res *Response) {
 		return
 	}
 
+	if isStreamMethod(mtype) {
+		stream, finish = openStream(thecall)
+	}
+
 	argv := make([]reflect.Value, len(mtype.inTypes))
 	//replyv := make([]reflect.Value, len(mtype.outTypes))
 	argv[0] = s.rcvr
@@ -101,6 +113,15 @@ func (s *service) Call(thecall *callInfo, res *Response) {
 		}
 	}
 
+	if stream != nil && outResult != nil && isStreamChannel(reflect.TypeOf(outResult)) {
+		if ch := reflect.ValueOf(outResult); !ch.IsNil() {
+			if err := stream.drain(ch); err != nil {
+				res.Error = err.Error()
+			}
+		}
+		return
+	}
+
 	res.Data = outResult
 }
 
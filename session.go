@@ -0,0 +1,222 @@
+package go_remote
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// SessionConfig configures resumable sessions of websocket clients
+//
+// Client opens a session with "resume" parameter and receives a secret token in the start message.
+// Reconnect with the "session" parameter during the grace period restores connection id, subscriptions
+// and connection state, user handlers are not called for such reconnect.
+//
+// In the reliable mode ( "reliable" parameter ) each event receives a sequence number and is stored till
+// the client acknowledges it with { "action":"ack", "body":{ "seq": N } } message, all not acknowledged
+// events are sent again after reconnect. When MaxPending is reached, events are lost and the session can't be
+// resumed anymore, reconnect starts a new session, so the client must load its state again
+type SessionConfig struct {
+	// GracePeriod is how long a session of a disconnected client is stored, default is 30 seconds
+	GracePeriod time.Duration
+	// MaxPending is a max count of not acknowledged events, default is 1000
+	MaxPending int
+}
+
+// StartInfo is sent in the start message of a client with a session
+type StartInfo struct {
+	ID      int    `json:"id"`
+	Session string `json:"session"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+type pendingEvent struct {
+	seq  uint64
+	data []byte
+}
+
+type session struct {
+	mu       sync.Mutex
+	token    string
+	user     int
+	reliable bool
+	seq      uint64
+	pending  []pendingEvent
+	client   *Client
+	attached bool
+	timer    *time.Timer
+	// lost is set when events were dropped, such session can't be resumed
+	lost bool
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	config   SessionConfig
+	sessions map[string]*session
+}
+
+func newSessionStore(config SessionConfig) *sessionStore {
+	if config.GracePeriod <= 0 {
+		config.GracePeriod = 30 * time.Second
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 1000
+	}
+
+	return &sessionStore{config: config, sessions: make(map[string]*session)}
+}
+
+// open resumes the session of the user or creates a new one,
+// it returns the previous client of the resumed session
+func (s *sessionStore) open(token string, c *Client, reliable bool) (*session, *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || sess.user != c.User || sess.lost {
+		sess = &session{token: newToken(), user: c.User}
+		s.sessions[sess.token] = sess
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+	if !sess.reliable || !reliable {
+		// events without sequence numbers can't be acknowledged
+		sess.pending = nil
+	}
+	sess.reliable = reliable
+
+	old := sess.client
+	sess.client = c
+	sess.attached = true
+
+	return sess, old
+}
+
+// remove deletes the new session of a rejected connection
+func (s *sessionStore) remove(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sess.token)
+}
+
+// detach marks the session as disconnected, the client is released
+// if the session is not resumed during the grace period
+func (s *sessionStore) detach(sess *session, c *Client) {
+	sess.mu.Lock()
+	if sess.client != c {
+		// session was resumed by other connection, which took the state of the client
+		sess.mu.Unlock()
+		return
+	}
+
+	sess.attached = false
+	lost := sess.lost
+	if !lost {
+		sess.timer = time.AfterFunc(s.config.GracePeriod, func() {
+			s.expire(sess, c)
+		})
+	}
+	sess.mu.Unlock()
+
+	if lost {
+		s.expire(sess, c)
+	}
+}
+
+// expire removes the detached session and releases its client, it does nothing
+// when the session is attached or is already removed
+func (s *sessionStore) expire(sess *session, c *Client) {
+	s.mu.Lock()
+	sess.mu.Lock()
+	expired := sess.client == c && !sess.attached && s.sessions[sess.token] == sess
+	if expired {
+		delete(s.sessions, sess.token)
+	}
+	sess.mu.Unlock()
+	s.mu.Unlock()
+
+	if expired {
+		c.release()
+	}
+}
+
+// close releases clients of all disconnected sessions
+func (s *sessionStore) close() {
+	s.mu.Lock()
+	detached := make(map[*session]*Client)
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		if !sess.attached {
+			if sess.timer != nil {
+				sess.timer.Stop()
+			}
+			detached[sess] = sess.client
+		}
+		sess.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	for sess, c := range detached {
+		s.expire(sess, c)
+	}
+}
+
+// add stores the event of the reliable session and returns its serialized form,
+// it fails when there are too many not acknowledged events, such session is marked as lost
+func (sess *session) add(r *ResponseMessage, max int) ([]byte, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.lost || len(sess.pending) >= max {
+		sess.lost = true
+		return nil, false
+	}
+
+	sess.seq += 1
+	r.Seq = sess.seq
+	data, _ := json.Marshal(r)
+	sess.pending = append(sess.pending, pendingEvent{seq: r.Seq, data: data})
+
+	return data, true
+}
+
+// ack removes events, which were received by the client
+func (sess *session) ack(seq uint64) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	i := 0
+	for i < len(sess.pending) && sess.pending[i].seq <= seq {
+		i++
+	}
+	sess.pending = sess.pending[i:]
+}
+
+// unacknowledged returns all stored events
+func (sess *session) unacknowledged() [][]byte {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	out := make([][]byte, len(sess.pending))
+	for i := range sess.pending {
+		out[i] = sess.pending[i].data
+	}
+	return out
+}
+
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+package go_remote
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionOpen(t *testing.T) {
+	store := newSessionStore(SessionConfig{GracePeriod: time.Minute})
+	first := &Client{User: 1}
+	sess, _ := store.open("", first, false)
+	store.detach(sess, first)
+
+	tests := []struct {
+		name    string
+		token   string
+		client  *Client
+		resumed bool
+	}{
+		{"unknown token", "unknown", &Client{User: 1}, false},
+		{"other user", sess.token, &Client{User: 2}, false},
+		{"same user", sess.token, &Client{User: 1}, true},
+	}
+
+	for _, test := range tests {
+		next, old := store.open(test.token, test.client, false)
+		if test.resumed {
+			if next != sess || old != first {
+				t.Errorf("%s: session was not resumed", test.name)
+			}
+		} else if next == sess || old != nil {
+			t.Errorf("%s: session of other connection was resumed", test.name)
+		}
+		if store.sessions[next.token] != next {
+			t.Errorf("%s: session was not stored", test.name)
+		}
+	}
+
+	if sess.timer != nil || !sess.attached {
+		t.Errorf("resumed session was not attached")
+	}
+}
+
+func TestSessionAck(t *testing.T) {
+	tests := []struct {
+		ack      uint64
+		expected []uint64
+	}{
+		{0, []uint64{1, 2, 3}},
+		{2, []uint64{3}},
+		{3, []uint64{}},
+		{10, []uint64{}},
+	}
+
+	for _, test := range tests {
+		sess := &session{reliable: true}
+		for i := 0; i < 3; i++ {
+			sess.add(&ResponseMessage{Action: "event"}, 3)
+		}
+		if _, ok := sess.add(&ResponseMessage{Action: "event"}, 3); ok {
+			t.Errorf("ack %d: event over the limit was stored", test.ack)
+		}
+
+		sess.ack(test.ack)
+		seqs := make([]uint64, 0)
+		for _, data := range sess.unacknowledged() {
+			r := ResponseMessage{}
+			json.Unmarshal(data, &r)
+			seqs = append(seqs, r.Seq)
+		}
+		if !reflect.DeepEqual(seqs, test.expected) {
+			t.Errorf("ack %d: incorrect pending events %v", test.ack, seqs)
+		}
+	}
+}
+
+func TestSessionResumePending(t *testing.T) {
+	tests := []struct {
+		name     string
+		reliable bool
+		pending  int
+	}{
+		{"reliable", true, 2},
+		{"not reliable", false, 0},
+	}
+
+	for _, test := range tests {
+		store := newSessionStore(SessionConfig{GracePeriod: time.Minute})
+		first := &Client{User: 1}
+		sess, _ := store.open("", first, true)
+		sess.add(&ResponseMessage{Action: "event"}, 10)
+		sess.add(&ResponseMessage{Action: "event"}, 10)
+		store.detach(sess, first)
+
+		store.open(sess.token, &Client{User: 1}, test.reliable)
+		if len(sess.unacknowledged()) != test.pending {
+			t.Errorf("%s: expected %d pending events, got %d", test.name, test.pending, len(sess.unacknowledged()))
+		}
+	}
+}
+
+func TestSessionLostEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		detached bool
+	}{
+		{"attached", false},
+		{"detached", true},
+	}
+
+	for _, test := range tests {
+		s := NewServer(&ServerConfig{WebSocket: true, Session: SessionConfig{GracePeriod: time.Minute, MaxPending: 1}})
+		c := &Client{Server: s, User: 1, reliable: true, done: make(chan struct{}), closing: make(chan []byte, 1)}
+		c.queue = newSendQueue(QueueConfig{}, &s.Events.dropped)
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		c.session, _ = s.sessions.open("", c, true)
+		if test.detached {
+			close(c.done)
+			s.sessions.detach(c.session, c)
+		}
+
+		c.sendEvent(&ResponseMessage{Action: "event"})
+		c.sendEvent(&ResponseMessage{Action: "event"})
+		if !test.detached {
+			if len(c.closing) == 0 {
+				t.Errorf("%s: client was not closed", test.name)
+			}
+			close(c.done)
+			s.sessions.detach(c.session, c)
+		}
+
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("%s: client of the lost session was not released", test.name)
+		}
+		if _, ok := s.sessions.sessions[c.session.token]; ok {
+			t.Errorf("%s: lost session was not removed", test.name)
+		}
+
+		next, old := s.sessions.open(c.session.token, &Client{User: 1}, true)
+		if next == c.session || old != nil {
+			t.Errorf("%s: lost session was resumed", test.name)
+		}
+		s.Events.Stop()
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,44 +14,119 @@ import (
 type ConnectionID int64
 
 type Client struct {
+	// Send passes raw messages to the send queue of the client
+	//
+	// Deprecated: use SendMessage, messages of the channel can't be dropped or coalesced
 	Send   chan []byte
 	Server *Server
 	User   int
 	ConnID int
 
-	conn *websocket.Conn
-	ctx  context.Context
+	conn     *websocket.Conn
+	ctx      context.Context
+	queue    *sendQueue
+	session  *session
+	reliable bool
+	calls    *clientCalls
+	streams  *streamRegistry
+	cancel   context.CancelFunc
+	closing  chan []byte
+	done     chan struct{}
+
+	limits        SocketConfig
+	inflight      int32
+	subscriptions *subscriptionSet
+	pool          *workerPool
 }
 
 type ResponseMessage struct {
 	Action string      `json:"action"`
+	ID     string      `json:"id,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Seq    uint64      `json:"seq,omitempty"`
 	Body   interface{} `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
 }
 
 type RequestMessage struct {
 	Action string          `json:"action"`
+	ID     string          `json:"id,omitempty"`
 	Name   string          `json:"name"`
 	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Each enables sending of each call result separately, as soon as the call is finished
+	Each bool `json:"each,omitempty"`
 }
 
 const pongWait = 60 * time.Second
-const pingPeriod = (pongWait * 9) / 10
 
+// MaxSocketMessageSize is a default max size of incoming messages, see SocketConfig
 var MaxSocketMessageSize = 4000
 
 const writeWait = 10 * time.Second
 
+const (
+	// CloseSlowConsumer is a close code for clients, which can't receive messages fast enough
+	CloseSlowConsumer = 4000
+	// CloseSessionResumed is a close code for a client, which session was resumed by a new connection
+	CloseSessionResumed = 4001
+	// CloseTooManyCalls is a close code for a client, which exceeds the limit of in-flight calls
+	CloseTooManyCalls = 4002
+	// CloseTooManySubscriptions is a close code for a client, which exceeds the limit of subscriptions
+	CloseTooManySubscriptions = 4003
+	// CloseTooManyConnections is a close code for a connection, which exceeds the limit of user connections
+	CloseTooManyConnections = 4004
+)
+
+// limitError is an error of request, which exceeds the limit of the connection,
+// the connection is closed with the code after the error is sent
+type limitError struct {
+	code int
+	text string
+}
+
+func (e *limitError) Error() string {
+	return e.text
+}
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
+// Start runs the client, which is already registered in the hub
 func (c *Client) Start() {
 	go c.readPump()
 	go c.writePump()
 
-	c.Server.Events.UserIn(c.User, c.ConnID)
-	c.SendMessage("start", c.ConnID)
+	if c.session == nil {
+		c.SendMessage("start", c.ConnID)
+		return
+	}
+
+	c.sendStart(false)
+}
+
+// resume starts the client, which takes subscriptions and state of the previous connection of the session
+func (c *Client) resume(old *Client) {
+	go c.readPump()
+	go c.writePump()
+
+	// events are sent by the hub, so inside of the hub loop nothing can be sent to
+	// the previous connection after the replacement
+	c.Server.Events.do(func() {
+		c.Server.Events.replace(old, c)
+		c.sendStart(true)
+	})
+	old.Close(CloseSessionResumed, "session resumed by other connection")
+}
+
+// sendStart sends the session token and all not acknowledged events
+func (c *Client) sendStart(resumed bool) {
+	c.SendMessage("start", &StartInfo{ID: c.ConnID, Session: c.session.token, Resumed: resumed})
+	for _, m := range c.session.unacknowledged() {
+		c.queue.push(queuedMessage{data: m})
+	}
 }
 
 func (c *Client) Context() context.Context {
@@ -57,20 +134,98 @@ func (c *Client) Context() context.Context {
 }
 
 func (c *Client) SendMessage(name string, body interface{}) {
-	m, _ := json.Marshal(&ResponseMessage{Action: name, Body: body})
-	c.Send <- m
+	c.send(&ResponseMessage{Action: name, Body: body})
+}
+
+// send adds message to the send queue, it never blocks
+func (c *Client) send(r *ResponseMessage) {
+	if c.reliable && r.Action == "event" {
+		c.sendEvent(r)
+		return
+	}
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	m, _ := json.Marshal(r)
+	if !c.queue.push(queuedMessage{data: m, key: queueKey(r), droppable: isDroppable(r)}) {
+		c.Close(CloseSlowConsumer, "slow consumer")
+	}
+}
+
+// sendEvent stores the event of the reliable mode till acknowledgement, so it is never dropped,
+// events of a disconnected client are stored as well and are sent when the session is resumed
+func (c *Client) sendEvent(r *ResponseMessage) {
+	m, ok := c.session.add(r, c.Server.sessions.config.MaxPending)
+	if !ok {
+		// event is lost, so the session can't be resumed and the client must start a new one
+		select {
+		case <-c.done:
+			// events are sent by the hub loop, which is used by release
+			go c.Server.sessions.expire(c.session, c)
+		default:
+			c.Close(CloseSlowConsumer, "too many not acknowledged events")
+		}
+		return
+	}
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.queue.push(queuedMessage{data: m})
+}
+
+// isDroppable checks whether message is initiated by the server and can be dropped for a slow client
+func isDroppable(r *ResponseMessage) bool {
+	return r.Action == "event" || r.Action == "presence" || r.Action == "data"
+}
+
+// queueKey returns a key, which is used to coalesce messages of the same channel or variable
+func queueKey(r *ResponseMessage) string {
+	switch body := r.Body.(type) {
+	case *Message:
+		return "event:" + body.Channel
+	case *DataMessage:
+		return "data:" + body.Name
+	}
+	return ""
+}
+
+// Close sends all queued messages and closes the connection with the code and reason
+func (c *Client) Close(code int, reason string) {
+	select {
+	case c.closing <- websocket.FormatCloseMessage(code, reason):
+	default:
+	}
+}
+
+// sendError reports a failed request, error has the same id as the request
+func (c *Client) sendError(m *RequestMessage, text string) {
+	c.send(&ResponseMessage{Action: "error", ID: m.ID, Name: m.Name, Error: text})
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.Server.Events.UserOut(c.User, c.ConnID)
-		c.Server.Events.UnSubscribe("", c)
+		close(c.done)
+		c.streams.cancelAll()
 		c.conn.Close()
+		if c.session != nil {
+			// subscriptions are kept till the end of the grace period
+			c.Server.sessions.detach(c.session, c)
+		} else {
+			c.release()
+		}
+		c.Server.connections.Done()
 	}()
-	c.conn.SetReadLimit(int64(MaxSocketMessageSize))
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(c.limits.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.limits.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.limits.PongWait))
 		return nil
 	})
 
@@ -84,40 +239,284 @@ func (c *Client) readPump() {
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
-		go c.process(message)
+		c.dispatch(message)
 	}
 }
 
-func (c *Client) process(message []byte) {
+// dispatch processes the message in the worker pools of the connection and the server
+func (c *Client) dispatch(message []byte) {
 	m := RequestMessage{}
 	err := json.Unmarshal(message, &m)
 	if err != nil {
 		log.Errorf("invalid message: %s", message)
 		log.Errorf(err.Error())
+		c.sendError(&m, "Invalid message")
 		return
 	}
 
-	if m.Action == "subscribe" {
-		c.Server.Events.Subscribe(m.Name, c)
+	// replies, acks and cancels are not limited, calls and events can wait for them
+	if m.Action == "reply" || m.Action == "ack" || m.Action == "cancel" {
+		c.process(&m)
+		return
 	}
 
-	if m.Action == "unsubscribe" {
-		c.Server.Events.UnSubscribe(m.Name, c)
+	// each call of the message takes its own place in the pools, so the message doesn't hold a worker
+	if m.Action == "call" {
+		go c.process(&m)
+		return
 	}
 
-	if m.Action == "call" {
-		res := c.Server.Process(m.Body, c.ctx)
-		if len(res) < 1 {
-			log.Errorf("somehow process doesn't return results")
+	pools := socketPools{client: c}
+	if err := pools.reserve(); err != nil {
+		c.sendError(&m, err.Error())
+		return
+	}
+
+	go func() {
+		pools.acquire()
+		defer pools.release()
+
+		c.process(&m)
+	}()
+}
+
+// socketCalls limits calls of the websocket message by the worker pools and by the max count of in-flight calls,
+// reserve is called from the goroutine of the message only
+type socketCalls struct {
+	socketPools
+	exceeded bool
+}
+
+func (p *socketCalls) reserve() error {
+	c := p.client
+	if max := c.limits.MaxCalls; max > 0 {
+		if int(atomic.AddInt32(&c.inflight, 1)) > max {
+			atomic.AddInt32(&c.inflight, -1)
+			p.exceeded = true
+			return errors.New("Too many calls")
+		}
+	}
+
+	if err := p.socketPools.reserve(); err != nil {
+		p.done()
+		return err
+	}
+	return nil
+}
+
+func (p *socketCalls) release() {
+	p.socketPools.release()
+	p.done()
+}
+
+func (p *socketCalls) done() {
+	if p.client.limits.MaxCalls > 0 {
+		atomic.AddInt32(&p.client.inflight, -1)
+	}
+}
+
+// socketPools limits processing by the worker pools of the connection and the server
+type socketPools struct {
+	client *Client
+}
+
+func (p socketPools) reserve() error {
+	if !p.client.pool.reserve() {
+		return errBusy
+	}
+	if !p.client.Server.pool.reserve() {
+		p.client.pool.cancel()
+		return errBusy
+	}
+	return nil
+}
+
+func (p socketPools) acquire() {
+	p.client.pool.acquire()
+	p.client.Server.pool.acquire()
+}
+
+func (p socketPools) release() {
+	p.client.Server.pool.release()
+	p.client.pool.release()
+}
+
+// release removes the client from the hub and closes its connection scope
+func (c *Client) release() {
+	c.Server.Events.disconnect(c)
+	c.Server.Events.UnSubscribe("", c)
+	closeDependencyScope(c.ctx, ConnectionScope)
+	c.cancel()
+}
+
+func (c *Client) process(m *RequestMessage) {
+	var err error
+	switch m.Action {
+	case "subscribe":
+		err = c.subscribe(m)
+	case "unsubscribe":
+		err = c.unsubscribe(m)
+	case "publish":
+		err = c.publish(m)
+	case "presence":
+		err = c.setPresence(m)
+	case "ack":
+		err = c.ack(m)
+	case "reply":
+		// reply is the response for the server request, so it is not acknowledged
+		err = c.reply(m)
+		if err == nil {
 			return
 		}
+	case "cancel":
+		// stream is finished with the error message, so cancel is not acknowledged
+		c.streams.cancel(m.ID, m.Name)
+		return
+	case "call":
+		// result message is the response for the call
+		err = c.call(m)
+		if err == nil {
+			return
+		}
+	default:
+		err = errors.New("Unknown action")
+	}
+
+	if err != nil {
+		c.sendError(m, err.Error())
+		if limit, ok := err.(*limitError); ok {
+			c.Close(limit.code, limit.text)
+		}
+	} else if m.ID != "" {
+		c.send(&ResponseMessage{Action: "ack", ID: m.ID, Name: m.Name})
+	}
+}
+
+func (c *Client) subscribe(m *RequestMessage) error {
+	if err := validateChannelName(m.Name); err != nil {
+		return err
+	}
+
+	if !c.Server.Events.CanSubscribe(m.Name, c) {
+		return errors.New("Access Denied")
+	}
+
+	var replay *ReplayOptions
+	if len(m.Body) != 0 {
+		replay = &ReplayOptions{}
+		err := json.Unmarshal(m.Body, replay)
+		if err != nil {
+			log.Errorf("invalid replay options: %s", m.Body)
+			return errors.New("Invalid replay options")
+		}
+	}
+
+	// subscription is counted only when the request is valid
+	if !c.subscriptions.add(m.Name, c.limits.MaxSubscriptions) {
+		return &limitError{code: CloseTooManySubscriptions, text: "Too many subscriptions"}
+	}
+
+	if replay == nil {
+		c.Server.Events.Subscribe(m.Name, c)
+		return nil
+	}
+
+	c.Server.Events.SubscribeWithReplay(m.Name, c, replay)
+	return nil
+}
+
+func (c *Client) unsubscribe(m *RequestMessage) error {
+	// empty name removes all subscriptions of the client
+	if m.Name != "" {
+		if err := validateChannelName(m.Name); err != nil {
+			return err
+		}
+	}
+
+	c.Server.Events.UnSubscribe(m.Name, c)
+	c.subscriptions.remove(m.Name)
+	return nil
+}
+
+func (c *Client) setPresence(m *RequestMessage) error {
+	var meta interface{}
+	if len(m.Body) != 0 {
+		meta = m.Body
+	}
+
+	c.Server.Events.SetPresenceMeta(c, meta)
+	return nil
+}
+
+func (c *Client) ack(m *RequestMessage) error {
+	if !c.reliable {
+		return errors.New("Reliable mode is not enabled")
+	}
+
+	info := struct {
+		Seq uint64 `json:"seq"`
+	}{}
+	if err := json.Unmarshal(m.Body, &info); err != nil {
+		return errors.New("Invalid ack")
+	}
+
+	c.session.ack(info.Seq)
+	return nil
+}
+
+func (c *Client) call(m *RequestMessage) error {
+	// the message is in-flight until its response is queued, so Shutdown doesn't close the connection before
+	if !c.Server.track(&c.Server.calls) {
+		return errors.New("Server is shutting down")
+	}
+	defer c.Server.calls.Done()
+
+	calls := &socketCalls{socketPools: socketPools{client: c}}
+	ctx := context.WithValue(c.ctx, streamTransportValue, &socketStream{client: c, message: m.ID})
+	ctx = context.WithValue(ctx, callPoolValue, calls)
 
-		c.SendMessage("result", &res)
+	var err error
+	if m.Each {
+		err = c.callEach(m, ctx)
+	} else {
+		err = c.callBatch(m, ctx)
 	}
+
+	// the connection is closed after results of the accepted calls are sent
+	if err == nil && calls.exceeded {
+		return &limitError{code: CloseTooManyCalls, text: "Too many calls"}
+	}
+	return err
+}
+
+// callBatch sends a "result" message with results of all calls of the batch
+func (c *Client) callBatch(m *RequestMessage, ctx context.Context) error {
+	res := c.Server.Process(m.Body, ctx)
+	if len(res) < 1 {
+		log.Errorf("somehow process doesn't return results")
+		return errors.New("Invalid call")
+	}
+
+	c.send(&ResponseMessage{Action: "result", ID: m.ID, Body: &res})
+	return nil
+}
+
+// callEach sends a "response" message for each call of the batch
+func (c *Client) callEach(m *RequestMessage, ctx context.Context) error {
+	count := 0
+	c.Server.ProcessEach(m.Body, ctx, func(r *Response) {
+		count += 1
+		c.send(&ResponseMessage{Action: "response", ID: m.ID, Body: r})
+	})
+
+	if count < 1 {
+		return errors.New("Invalid call")
+	}
+	return nil
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.limits.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -125,49 +524,56 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.queue.notify:
+			c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
+			if err := c.flush(); err != nil {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+		case message := <-c.Send:
+			if !c.queue.push(queuedMessage{data: message}) {
+				c.Close(CloseSlowConsumer, "slow consumer")
 			}
-			_, err = w.Write(message)
-			if err != nil {
-				return
-			}
-			err = w.Close()
-			if err != nil {
+
+		case frame := <-c.closing:
+			c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
+			if err := c.flush(); err != nil {
 				return
 			}
+			c.conn.WriteMessage(websocket.CloseMessage, frame)
+			return
 
-			// Add queued messages to the current websocket message.
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w, err := c.conn.NextWriter(websocket.TextMessage)
-				if err != nil {
-					return
-				}
-				_, err = w.Write(<-c.Send)
-				if err != nil {
-					return
-				}
-				err = w.Close()
-				if err != nil {
-					return
-				}
-			}
+		case <-c.done:
+			return
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// flush writes all queued messages
+func (c *Client) flush() error {
+	for _, message := range c.queue.take() {
+		if err := c.write(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) write(message []byte) error {
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
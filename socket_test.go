@@ -0,0 +1,306 @@
+package go_remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSocket opens a websocket connection to the test server with the query parameters
+func dialSocket(t *testing.T, ts *httptest.Server, query string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?ws=1"+query, nil)
+	if err != nil {
+		t.Fatalf("can't open websocket, %v", err)
+	}
+
+	return conn
+}
+
+func readSocket(t *testing.T, conn *websocket.Conn) ResponseMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("can't read message, %v", err)
+	}
+
+	m := ResponseMessage{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("invalid message %s, %v", data, err)
+	}
+	return m
+}
+
+func TestClientSendChannel(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	clients := make(chan *Client, 1)
+	s.Events.ConnHandler = func(u *UserChange) {
+		if u.Status {
+			clients <- u.client
+		}
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	c := <-clients
+	c.Send <- []byte(`{"action":"raw"}`)
+	if m := readSocket(t, conn); m.Action != "raw" {
+		t.Errorf("message of the Send channel was not delivered, %+v", m)
+	}
+}
+
+func TestMaxUserConnections(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    string
+		second   string
+		rejected bool
+	}{
+		{"new connection", "", "", true},
+		{"session without resume", "&resume=1", "&session=TOKEN", true},
+		{"new session", "&resume=1", "&resume=1", true},
+		{"resumed session", "&resume=1", "&resume=1&session=TOKEN", false},
+	}
+
+	for _, test := range tests {
+		s := NewServer(&ServerConfig{WebSocket: true, Socket: SocketConfig{MaxUserConnections: 1}})
+		s.Connect = func(r *http.Request) (context.Context, error) {
+			return context.WithValue(r.Context(), UserValue, 1), nil
+		}
+		ts := httptest.NewServer(s)
+
+		first := dialSocket(t, ts, test.first)
+		start := readSocket(t, first)
+		token := ""
+		if info, ok := start.Body.(map[string]interface{}); ok {
+			token, _ = info["session"].(string)
+		}
+
+		second := dialSocket(t, ts, strings.Replace(test.second, "TOKEN", token, 1))
+		second.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := second.ReadMessage()
+		closed, _ := err.(*websocket.CloseError)
+		if test.rejected && (closed == nil || closed.Code != CloseTooManyConnections) {
+			t.Errorf("%s: connection was not rejected, %v", test.name, err)
+		}
+		if !test.rejected && err != nil {
+			t.Errorf("%s: connection was rejected, %v", test.name, err)
+		}
+
+		first.Close()
+		second.Close()
+		ts.Close()
+	}
+}
+
+func TestSubscribeLimitIgnoresInvalidRequests(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true, Socket: SocketConfig{MaxSubscriptions: 1}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","name":"users","body":"invalid"}`))
+	if m := readSocket(t, conn); m.Error != "Invalid replay options" {
+		t.Fatalf("invalid request was accepted, %+v", m)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","name":"orders"}`))
+	for i := 0; len(s.Events.Status().Channels["orders"].Connections) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("valid request was rejected, %+v", readSocket(t, conn))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type SlowService struct {
+	started chan bool
+	release chan bool
+}
+
+func (s *SlowService) Slow() string {
+	s.started <- true
+	<-s.release
+	return "slow"
+}
+
+func (s *SlowService) Fast() string {
+	return "fast"
+}
+
+func TestShutdownWaitsForSocketCalls(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	service := &SlowService{started: make(chan bool, 1), release: make(chan bool)}
+	s.AddService("slow", service)
+	disconnected := make(chan bool, 1)
+	s.Events.UserHandler = func(u *UserChange) {
+		if !u.Status {
+			disconnected <- true
+		}
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"call","id":"m1","body":[{"id":"1","name":"slow.Slow","args":[]}]}`))
+	<-service.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	for !s.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	close(service.release)
+
+	m := readSocket(t, conn)
+	if m.Action != "result" || m.ID != "m1" {
+		t.Fatalf("result of the in-flight call was not delivered, %+v", m)
+	}
+	if res := m.Body.([]interface{})[0].(map[string]interface{}); res["data"] != "slow" {
+		t.Errorf("incorrect result of the in-flight call, %+v", res)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	closed, _ := err.(*websocket.CloseError)
+	if closed == nil || closed.Code != websocket.CloseGoingAway || closed.Text != "server is shutting down" {
+		t.Errorf("connection was not closed by the server, %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown is failed, %v", err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Errorf("disconnect handler was not called")
+	}
+}
+
+func TestMaxCallsCountsBatchCalls(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true, Socket: SocketConfig{MaxCalls: 1}})
+	service := &SlowService{started: make(chan bool, 1), release: make(chan bool)}
+	s.AddService("slow", service)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"call","id":"m1","body":[
+		{"id":"1","name":"slow.Slow","args":[]},
+		{"id":"2","name":"slow.Fast","args":[]}]}`))
+	<-service.started
+	close(service.release)
+
+	m := readSocket(t, conn)
+	res, _ := m.Body.([]interface{})
+	if m.Action != "result" || len(res) != 2 {
+		t.Fatalf("incorrect result of the batch, %+v", m)
+	}
+	for _, r := range res {
+		r := r.(map[string]interface{})
+		if r["id"] == "1" && r["data"] != "slow" || r["id"] == "2" && r["error"] != "Too many calls" {
+			t.Errorf("incorrect result of the call, %+v", r)
+		}
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if closed, ok := err.(*websocket.CloseError); !ok || closed.Code != CloseTooManyCalls {
+			t.Errorf("connection was not closed, %v", err)
+		}
+		break
+	}
+}
+
+func TestMaxUserConnectionsConcurrent(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true, Socket: SocketConfig{MaxUserConnections: 1}})
+	s.Connect = func(r *http.Request) (context.Context, error) {
+		return context.WithValue(r.Context(), UserValue, 1), nil
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	accepted := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?ws=1", nil)
+			if err != nil {
+				accepted <- false
+				return
+			}
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = conn.ReadMessage()
+			accepted <- err == nil
+			if err == nil {
+				// the accepted connection is kept open till the end of the test
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				conn.ReadMessage()
+			}
+		}()
+	}
+
+	count := 0
+	for i := 0; i < 10; i++ {
+		if <-accepted {
+			count += 1
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected one accepted connection, got %d", count)
+	}
+}
+
+func TestSocketCallEach(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	service := &SlowService{started: make(chan bool, 1), release: make(chan bool)}
+	s.AddService("slow", service)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"call","id":"m1","each":true,"body":[
+		{"id":"1","name":"slow.Slow","args":[]},
+		{"id":"2","name":"slow.Fast","args":[]}]}`))
+
+	// slow call is blocked till the response of the fast call is received
+	<-service.started
+	for _, expected := range []string{"fast", "slow"} {
+		m := readSocket(t, conn)
+		res, _ := m.Body.(map[string]interface{})
+		if m.Action != "response" || m.ID != "m1" || res["data"] != expected {
+			t.Fatalf("expected response of the %s call, got %+v", expected, m)
+		}
+		if expected == "fast" {
+			close(service.release)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package go_remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// Stream sends parts of the method result to the caller
+//
+// Method receives the stream as an argument or returns a receive-only channel, which is
+// streamed till it is closed. Over websocket each part is sent as "chunk" message, followed
+// by "end" or "error" message, over HTTP with "Accept: application/x-ndjson" header each part
+// is a line of the response. When transport can't stream, parts are returned as an array
+type Stream struct {
+	ID string
+
+	ctx       context.Context
+	transport streamTransport
+
+	mu    sync.Mutex
+	parts []interface{}
+}
+
+// StreamMessage is a part of the streamed result
+type StreamMessage struct {
+	ID    string      `json:"id"`
+	Chunk interface{} `json:"chunk,omitempty"`
+	End   bool        `json:"end,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// streamTransport sends stream messages to the caller
+type streamTransport interface {
+	// write can block till the caller is ready to receive the chunk or the context is closed
+	write(ctx context.Context, m *StreamMessage) error
+	// register allows the caller to cancel the stream, returned function removes the registration
+	register(id string, cancel context.CancelFunc) func()
+}
+
+var streamTransportValue = key(7)
+var streamValue = key(8)
+
+var streamType = reflect.TypeOf((*Stream)(nil))
+
+// Context is closed when the caller cancels the stream or disconnects
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send passes the part of the result to the caller
+func (s *Stream) Send(chunk interface{}) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.transport == nil {
+		s.mu.Lock()
+		s.parts = append(s.parts, chunk)
+		s.mu.Unlock()
+		return nil
+	}
+
+	return s.transport.write(s.ctx, &StreamMessage{ID: s.ID, Chunk: chunk})
+}
+
+// isStreamMethod checks whether the method sends its result by parts
+func isStreamMethod(mtype *methodType) bool {
+	for _, t := range mtype.inTypes {
+		if t == streamType {
+			return true
+		}
+	}
+	for _, t := range mtype.outTypes {
+		if isStreamChannel(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isStreamChannel(t reflect.Type) bool {
+	return t.Kind() == reflect.Chan && t.ChanDir()&reflect.RecvDir != 0
+}
+
+// openStream creates the stream of the call, stream context is cancelled when the call is finished
+func openStream(call *callInfo) (*Stream, func(res *Response)) {
+	ctx, cancel := context.WithCancel(call.ctx)
+	transport, _ := ctx.Value(streamTransportValue).(streamTransport)
+
+	s := &Stream{ID: call.ID, transport: transport}
+	if transport == nil {
+		s.parts = make([]interface{}, 0)
+	}
+	s.ctx = context.WithValue(ctx, streamValue, s)
+	call.ctx = s.ctx
+
+	unregister := func() {}
+	if transport != nil {
+		unregister = transport.register(call.ID, cancel)
+	}
+
+	return s, func(res *Response) {
+		unregister()
+		cancel()
+		s.close(res)
+	}
+}
+
+// drain sends values of the channel to the stream till the channel is closed
+func (s *Stream) drain(ch reflect.Value) error {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.ctx.Done())},
+	}
+
+	for {
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return s.ctx.Err()
+		}
+		if !ok {
+			return nil
+		}
+		if err := s.Send(value.Interface()); err != nil {
+			return err
+		}
+	}
+}
+
+// close finishes the stream with the end or the error message,
+// without transport all parts become the call result
+func (s *Stream) close(res *Response) {
+	if s.transport == nil {
+		if res.Error == "" {
+			s.mu.Lock()
+			res.Data = s.parts
+			s.mu.Unlock()
+		}
+		return
+	}
+
+	// stream context is already closed, and the last message is sent without waiting
+	if res.Error != "" {
+		s.transport.write(s.ctx, &StreamMessage{ID: s.ID, Error: res.Error})
+	} else {
+		s.transport.write(s.ctx, &StreamMessage{ID: s.ID, End: true})
+	}
+}
+
+type streamKey struct {
+	message string
+	call    string
+}
+
+// streamRegistry stores cancel functions of streams of a websocket connection
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[streamKey]context.CancelFunc
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[streamKey]context.CancelFunc)}
+}
+
+func (r *streamRegistry) add(key streamKey, cancel context.CancelFunc) func() {
+	r.mu.Lock()
+	r.streams[key] = cancel
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.streams, key)
+		r.mu.Unlock()
+	}
+}
+
+// cancel stops the stream, empty call id stops all streams of the message
+func (r *streamRegistry) cancel(message, call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, cancel := range r.streams {
+		if key.message == message && (call == "" || key.call == call) {
+			cancel()
+		}
+	}
+}
+
+func (r *streamRegistry) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, cancel := range r.streams {
+		cancel()
+	}
+}
+
+// socketStream sends streams of the call message over websocket,
+// messages have id of the call message and name of the call
+type socketStream struct {
+	client  *Client
+	message string
+}
+
+func (t *socketStream) write(ctx context.Context, m *StreamMessage) error {
+	r := &ResponseMessage{ID: t.message, Name: m.ID}
+	switch {
+	case m.Error != "":
+		r.Action = "error"
+		r.Error = m.Error
+	case m.End:
+		r.Action = "end"
+	default:
+		// chunks are never dropped, so the stream waits for the slow client
+		if err := t.client.queue.wait(ctx, t.client.done); err != nil {
+			return err
+		}
+		r.Action = "chunk"
+		r.Body = m.Chunk
+	}
+
+	t.client.send(r)
+	select {
+	case <-t.client.done:
+		return errors.New("Client is disconnected")
+	default:
+		return nil
+	}
+}
+
+func (t *socketStream) register(id string, cancel context.CancelFunc) func() {
+	return t.client.streams.add(streamKey{message: t.message, call: id}, cancel)
+}
+
+// httpStream sends streams as lines of the HTTP response
+type httpStream struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	cancel context.CancelFunc
+}
+
+func (t *httpStream) write(ctx context.Context, m *StreamMessage) error {
+	return t.writeLine(m)
+}
+
+// writeLine writes the value as a line of the response, failed write cancels all streams
+func (t *httpStream) writeLine(value interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, _ := json.Marshal(value)
+	_, err := t.w.Write(append(data, '\n'))
+	if err != nil {
+		t.cancel()
+		return err
+	}
+
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (t *httpStream) register(id string, cancel context.CancelFunc) func() {
+	// streams are cancelled with the request
+	return func() {}
+}
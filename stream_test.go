@@ -0,0 +1,197 @@
+package go_remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type StreamService struct{}
+
+func (StreamService) Numbers(n int) <-chan int {
+	ch := make(chan int, n)
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	return ch
+}
+
+func (StreamService) Words(s *Stream) error {
+	s.Send("a")
+	s.Send("b")
+	return nil
+}
+
+func (StreamService) Fail(s *Stream) error {
+	s.Send("a")
+	return errors.New("failed")
+}
+
+func (StreamService) Wait(s *Stream) error {
+	s.Send("ready")
+	<-s.Context().Done()
+	return s.Context().Err()
+}
+
+func TestStreamWithoutTransport(t *testing.T) {
+	s := NewServer(nil)
+	s.AddService("stream", StreamService{})
+
+	tests := []struct {
+		call  string
+		data  interface{}
+		error string
+	}{
+		{`[{"id":"1","name":"stream.Numbers","args":[3]}]`, []interface{}{0, 1, 2}, ""},
+		{`[{"id":"1","name":"stream.Words","args":[]}]`, []interface{}{"a", "b"}, ""},
+		{`[{"id":"1","name":"stream.Fail","args":[]}]`, nil, "failed"},
+	}
+
+	for _, test := range tests {
+		res := s.Process([]byte(test.call), context.Background())
+		if len(res) != 1 || res[0].Error != test.error || !reflect.DeepEqual(res[0].Data, test.data) {
+			t.Errorf("%s: incorrect result %+v", test.call, res)
+		}
+	}
+}
+
+func TestSocketStream(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	s.AddService("stream", StreamService{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		method   string
+		args     string
+		expected []string
+	}{
+		{"Numbers", "[3]", []string{"chunk 0", "chunk 1", "chunk 2", "end", "result"}},
+		{"Words", "[]", []string{"chunk a", "chunk b", "end", "result"}},
+		{"Fail", "[]", []string{"chunk a", "error failed", "result failed"}},
+	}
+
+	for _, test := range tests {
+		conn := dialSocket(t, ts, "")
+		readSocket(t, conn)
+
+		call := `{"action":"call","id":"m1","body":[{"id":"1","name":"stream.` + test.method + `","args":` + test.args + `}]}`
+		conn.WriteMessage(websocket.TextMessage, []byte(call))
+
+		out := make([]string, 0)
+		for finished := false; !finished; {
+			m := readSocket(t, conn)
+			finished = m.Action == "result"
+			switch m.Action {
+			case "chunk":
+				out = append(out, fmt.Sprintf("chunk %v", m.Body))
+			case "error":
+				out = append(out, "error "+m.Error)
+			case "result":
+				res := m.Body.([]interface{})[0].(map[string]interface{})
+				out = append(out, strings.TrimSpace("result "+res["error"].(string)))
+			default:
+				out = append(out, m.Action)
+			}
+			if m.Action != "result" && (m.ID != "m1" || m.Name != "1") {
+				t.Errorf("%s: incorrect ids of the stream message %+v", test.method, m)
+			}
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%s: incorrect messages %v", test.method, out)
+		}
+		conn.Close()
+	}
+}
+
+func TestSocketStreamCancel(t *testing.T) {
+	s := NewServer(&ServerConfig{WebSocket: true})
+	s.AddService("stream", StreamService{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	conn := dialSocket(t, ts, "")
+	defer conn.Close()
+	readSocket(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"call","id":"m1","body":[{"id":"1","name":"stream.Wait","args":[]}]}`))
+	if m := readSocket(t, conn); m.Action != "chunk" {
+		t.Fatalf("stream was not started, %+v", m)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"cancel","id":"m1","name":"1"}`))
+	if m := readSocket(t, conn); m.Action != "error" || m.Error != context.Canceled.Error() {
+		t.Errorf("stream context was not closed, %+v", m)
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	s := NewServer(nil)
+	s.AddService("stream", StreamService{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		call     string
+		expected []string
+	}{
+		{`[{"id":"1","name":"stream.Numbers","args":[2]}]`, []string{
+			`{"id":"1","chunk":0}`, `{"id":"1","chunk":1}`, `{"id":"1","end":true}`, `{"id":"1","data":null,"error":""}`,
+		}},
+		{`[{"id":"1","name":"stream.Fail","args":[]}]`, []string{
+			`{"id":"1","chunk":"a"}`, `{"id":"1","error":"failed"}`, `{"id":"1","data":null,"error":"failed"}`,
+		}},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(test.call))
+		req.Header.Set("Accept", "application/x-ndjson")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed, %v", test.call, err)
+		}
+
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: incorrect response\n%s", test.call, body)
+		}
+	}
+}
+
+func TestSendQueueWait(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 1}, new(uint64))
+	q.push(queuedMessage{data: []byte("a")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan error, 1)
+	go func() { waiting <- q.wait(ctx, nil) }()
+
+	select {
+	case <-waiting:
+		t.Fatalf("sender doesn't wait for the full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.take()
+	if err := <-waiting; err != nil {
+		t.Errorf("sender was not resumed, %v", err)
+	}
+
+	q.push(queuedMessage{data: []byte("b")})
+	cancel()
+	if err := q.wait(ctx, nil); err != context.Canceled {
+		t.Errorf("closed context doesn't stop waiting, %v", err)
+	}
+}
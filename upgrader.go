@@ -0,0 +1,98 @@
+package go_remote
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// UpgraderConfig configures opening of websocket connections
+type UpgraderConfig struct {
+	// AllowedOrigins lists origins, which can open the websocket, like "https://app.example.com",
+	// "https://*.example.com" or "*" for any origin. When the list and CheckOrigin are empty,
+	// origin must have the same host as the request
+	AllowedOrigins []string
+	// CheckOrigin is a custom origin check, it is used instead of AllowedOrigins
+	CheckOrigin func(r *http.Request) bool
+
+	// ReadBufferSize and WriteBufferSize are sizes of IO buffers, default is 1024
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Subprotocols are supported protocols in order of preference
+	Subprotocols []string
+	// EnableCompression negotiates per message compression with the client
+	EnableCompression bool
+}
+
+func newUpgrader(config UpgraderConfig) *websocket.Upgrader {
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = 1024
+	}
+	if config.WriteBufferSize <= 0 {
+		config.WriteBufferSize = 1024
+	}
+
+	u := &websocket.Upgrader{
+		ReadBufferSize:    config.ReadBufferSize,
+		WriteBufferSize:   config.WriteBufferSize,
+		Subprotocols:      config.Subprotocols,
+		EnableCompression: config.EnableCompression,
+		CheckOrigin:       config.CheckOrigin,
+	}
+
+	if u.CheckOrigin == nil && len(config.AllowedOrigins) != 0 {
+		origins := config.AllowedOrigins
+		u.CheckOrigin = func(r *http.Request) bool {
+			return allowOrigin(origins, r)
+		}
+	}
+
+	return u
+}
+
+// allowOrigin checks the origin of the request against the list
+func allowOrigin(origins []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser request
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+
+	for _, pattern := range origins {
+		if matchOrigin(strings.ToLower(pattern), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOrigin checks whether the origin matches the pattern,
+// "*" in the pattern matches one or more subdomains
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return false
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@")
+}
@@ -0,0 +1,37 @@
+package go_remote
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAllowOrigin(t *testing.T) {
+	origins := []string{"https://app.example.com", "https://*.example.org", "http://localhost:8080"}
+	tests := []struct {
+		origin string
+		allow  bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"https://a.example.org:8080", false},
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if allowOrigin(origins, r) != test.allow {
+			t.Errorf("allowOrigin(%q) must be %v", test.origin, test.allow)
+		}
+	}
+}